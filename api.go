@@ -1,6 +1,8 @@
 package link
 
 import (
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"strings"
@@ -27,6 +29,24 @@ type ClearSendChan interface {
 	ClearSendChan(<-chan interface{})
 }
 
+// BufferedCodec can encode messages without writing them out, the async
+// sessions with SetBatch flush once per batch.
+type BufferedCodec interface {
+	SendBuffered(msg interface{}) error
+	Flush() error
+}
+
+type PreEncoder interface {
+	PreEncode(msg interface{}) (interface{}, error)
+}
+
+// PreEncoderCodec returns the PreEncoder shared by the codecs of a protocol,
+// broadcasts encode a message once per PreEncoder. It should be a pointer or
+// another comparable value, other encoders are called once per session.
+type PreEncoderCodec interface {
+	PreEncoder() PreEncoder
+}
+
 func Listen(network, address string, protocol Protocol, sendChanSize int, handler Handler) (*Server, error) {
 	listener, err := net.Listen(network, address)
 	if err != nil {
@@ -35,28 +55,55 @@ func Listen(network, address string, protocol Protocol, sendChanSize int, handle
 	return NewServer(listener, protocol, sendChanSize, handler), nil
 }
 
-func Dial(network, address string, protocol Protocol, sendChanSize int) (*Session, error) {
-	conn, err := net.Dial(network, address)
-	if err != nil {
-		return nil, err
-	}
-	codec, err := protocol.NewCodec(conn)
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+var _ Dialer = DialerFunc(nil)
+
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+func ListenTLS(network, address string, config *tls.Config, protocol Protocol, sendChanSize int, handler Handler) (*Server, error) {
+	listener, err := tls.Listen(network, address, config)
 	if err != nil {
 		return nil, err
 	}
-	return NewSession(codec, sendChanSize), nil
+	return NewServer(listener, protocol, sendChanSize, handler), nil
+}
+
+func Dial(network, address string, protocol Protocol, sendChanSize int) (*Session, error) {
+	return DialContext(context.Background(), network, address, protocol, sendChanSize)
 }
 
 func DialTimeout(network, address string, timeout time.Duration, protocol Protocol, sendChanSize int) (*Session, error) {
-	conn, err := net.DialTimeout(network, address, timeout)
+	return DialWith(context.Background(), &net.Dialer{Timeout: timeout}, network, address, protocol, sendChanSize)
+}
+
+func DialContext(ctx context.Context, network, address string, protocol Protocol, sendChanSize int) (*Session, error) {
+	return DialWith(ctx, new(net.Dialer), network, address, protocol, sendChanSize)
+}
+
+func DialTLS(network, address string, config *tls.Config, protocol Protocol, sendChanSize int) (*Session, error) {
+	return DialWith(context.Background(), &tls.Dialer{Config: config}, network, address, protocol, sendChanSize)
+}
+
+func DialWith(ctx context.Context, dialer Dialer, network, address string, protocol Protocol, sendChanSize int) (*Session, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
 	codec, err := protocol.NewCodec(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return NewSession(codec, sendChanSize), nil
+	session := NewSession(codec, sendChanSize)
+	session.conn = conn
+	return session, nil
 }
 
 func Accept(listener net.Listener) (net.Conn, error) {
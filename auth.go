@@ -0,0 +1,97 @@
+package link
+
+import (
+	"errors"
+	"time"
+)
+
+var AuthTimeoutError = errors.New("Auth Timeout")
+
+// Authenticator runs on every new session of a Server before the Handler.
+// It usually receives a login message or runs a challenge-response and
+// returns the identity of the client, see Session.Identity.
+type Authenticator interface {
+	Authenticate(*Session) (identity interface{}, err error)
+}
+
+var _ Authenticator = AuthenticatorFunc(nil)
+
+type AuthenticatorFunc func(*Session) (interface{}, error)
+
+func (f AuthenticatorFunc) Authenticate(session *Session) (interface{}, error) {
+	return f(session)
+}
+
+// AuthRejectedError can be returned by an Authenticator to send Reason to the
+// client before the session is closed.
+type AuthRejectedError struct {
+	Reason interface{}
+}
+
+func (e *AuthRejectedError) Error() string {
+	return "Auth Rejected"
+}
+
+// SetAuthenticator makes the Server authenticate new sessions before they
+// are put in the Manager and handed to the Handler. Sessions which are not
+// authenticated within timeout are closed, timeout 0 means no limit.
+// It must be called before Serve.
+func (server *Server) SetAuthenticator(auth Authenticator, timeout time.Duration) {
+	server.auth = auth
+	server.authTimeout = timeout
+}
+
+func (server *Server) authenticate(session *Session) error {
+	if server.auth == nil {
+		return nil
+	}
+
+	// Stop closes the sessions still authenticating, they are not in the
+	// Manager yet.
+	server.listenerMutex.Lock()
+	if server.stopped {
+		server.listenerMutex.Unlock()
+		session.Close()
+		return ServerStoppedError
+	}
+	if server.authSessions == nil {
+		server.authSessions = make(map[*Session]struct{})
+	}
+	server.authSessions[session] = struct{}{}
+	server.listenerMutex.Unlock()
+
+	defer func() {
+		server.listenerMutex.Lock()
+		delete(server.authSessions, session)
+		server.listenerMutex.Unlock()
+	}()
+
+	var timer *time.Timer
+	if server.authTimeout > 0 {
+		timer = time.AfterFunc(server.authTimeout, func() {
+			session.Close()
+		})
+	}
+	identity, err := server.auth.Authenticate(session)
+	if timer != nil && !timer.Stop() {
+		return AuthTimeoutError
+	}
+
+	if err != nil {
+		if rejected, ok := err.(*AuthRejectedError); ok && rejected.Reason != nil {
+			session.sendAndClose(rejected.Reason)
+		} else {
+			session.Close()
+		}
+		return err
+	}
+	if session.IsClosed() {
+		return SessionClosedError
+	}
+	session.identity = identity
+	return nil
+}
+
+func (session *Session) Identity() interface{} {
+	return session.identity
+}
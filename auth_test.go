@@ -0,0 +1,151 @@
+package link
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+var testSecret = []byte("secret")
+
+func sign(challenge []byte) []byte {
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+func Test_Authenticator(t *testing.T) {
+	for _, sendChanSize := range []int{0, 16} {
+		AuthenticatorTest(t, sendChanSize)
+	}
+}
+
+func AuthenticatorTest(t *testing.T, sendChanSize int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+
+	server := NewServer(listener, ProtocolFunc(NewTestCodec), sendChanSize, HandlerFunc(func(session *Session) {
+		session.Send([]byte(session.Identity().(string)))
+		session.Receive()
+	}))
+	server.SetAuthenticator(AuthenticatorFunc(func(session *Session) (interface{}, error) {
+		challenge := RandBytes(16)
+		if err := session.Send(challenge); err != nil {
+			return nil, err
+		}
+		msg, err := session.Receive()
+		if err != nil {
+			return nil, err
+		}
+		reply := msg.([]byte)
+		if len(reply) < sha256.Size || !hmac.Equal(reply[:sha256.Size], sign(challenge)) {
+			return nil, &AuthRejectedError{[]byte("denied")}
+		}
+		return string(reply[sha256.Size:]), nil
+	}), 200*time.Millisecond)
+	go server.Serve()
+	defer server.Stop()
+
+	login := func(secret bool) (*Session, []byte) {
+		session, err := Dial("tcp", listener.Addr().String(), ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		challenge, err := session.Receive()
+		utest.IsNilNow(t, err)
+		reply := []byte("bad signature...................")
+		if secret {
+			reply = sign(challenge.([]byte))
+		}
+		utest.IsNilNow(t, session.Send(append(reply, "alice"...)))
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		return session, msg.([]byte)
+	}
+
+	session, msg := login(true)
+	utest.Assert(t, bytes.Equal(msg, []byte("alice")))
+	session.Close()
+
+	session, msg = login(false)
+	utest.Assert(t, bytes.Equal(msg, []byte("denied")))
+	_, err = session.Receive()
+	utest.NotNilNow(t, err)
+	session.Close()
+
+	// No answer to the challenge.
+	session, err = Dial("tcp", listener.Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	_, err = session.Receive()
+	utest.IsNilNow(t, err)
+	start := time.Now()
+	_, err = session.Receive()
+	utest.NotNilNow(t, err)
+	utest.Assert(t, time.Since(start) > 100*time.Millisecond)
+	utest.EqualNow(t, server.Manager().Len(), 0)
+}
+
+func Test_AuthTimeoutError(t *testing.T) {
+	server := NewServer(nil, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {}))
+	server.SetAuthenticator(AuthenticatorFunc(func(session *Session) (interface{}, error) {
+		_, err := session.Receive()
+		return nil, err
+	}), 50*time.Millisecond)
+
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	codec, _ := NewTestCodec(conn)
+	session := newSession(server.manager, codec, 0)
+	utest.EqualNow(t, server.authenticate(session), AuthTimeoutError)
+	utest.Assert(t, session.IsClosed())
+
+	server.SetAuthenticator(AuthenticatorFunc(func(session *Session) (interface{}, error) {
+		return nil, errors.New("failed")
+	}), 0)
+	codec, _ = NewTestCodec(peer)
+	session = newSession(server.manager, codec, 0)
+	utest.NotNilNow(t, server.authenticate(session))
+	utest.Assert(t, session.IsClosed())
+}
+
+func Test_AuthStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+
+	authDone := make(chan error, 1)
+	server := NewServer(listener, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {}))
+	server.SetAuthenticator(AuthenticatorFunc(func(session *Session) (interface{}, error) {
+		_, err := session.Receive()
+		authDone <- err
+		return nil, err
+	}), 0)
+	go server.Serve()
+
+	session, err := Dial("tcp", listener.Addr().String(), ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+
+	for {
+		server.listenerMutex.Lock()
+		n := len(server.authSessions)
+		server.listenerMutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	server.Stop()
+
+	select {
+	case err := <-authDone:
+		utest.NotNilNow(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("authenticating session not closed by Stop")
+	}
+	_, err = session.Receive()
+	utest.NotNilNow(t, err)
+}
@@ -1,6 +1,7 @@
 package link
 
 import (
+	"reflect"
 	"sync"
 )
 
@@ -10,10 +11,33 @@ type Channel struct {
 	mutex    sync.RWMutex
 	sessions map[KEY]*Session
 
+	watcherMutex sync.Mutex
+	watchers     []channelWatcher
+
 	// channel state
 	State interface{}
 }
 
+type ChannelEventType int
+
+const (
+	ChannelJoin ChannelEventType = iota
+	ChannelLeaveRemove
+	ChannelLeaveReplace
+	ChannelLeaveClose
+)
+
+type ChannelEvent struct {
+	Type    ChannelEventType
+	Key     KEY
+	Session *Session
+}
+
+type channelWatcher struct {
+	key   interface{}
+	watch func(ChannelEvent)
+}
+
 func NewChannel() *Channel {
 	return &Channel{
 		sessions: make(map[KEY]*Session),
@@ -34,6 +58,86 @@ func (channel *Channel) Fetch(callback func(*Session)) {
 	}
 }
 
+func (channel *Channel) Broadcast(msg interface{}, filter func(*Session) bool) map[KEY]error {
+	channel.mutex.RLock()
+	keys := make([]KEY, 0, len(channel.sessions))
+	sessions := make([]*Session, 0, len(channel.sessions))
+	for key, session := range channel.sessions {
+		keys = append(keys, key)
+		sessions = append(sessions, session)
+	}
+	channel.mutex.RUnlock()
+
+	if filter != nil {
+		n := 0
+		for i, session := range sessions {
+			if filter(session) {
+				keys[n] = keys[i]
+				sessions[n] = session
+				n++
+			}
+		}
+		keys, sessions = keys[:n], sessions[:n]
+	}
+
+	var errs map[KEY]error
+	for i, err := range broadcast(sessions, msg) {
+		if err != nil {
+			if errs == nil {
+				errs = make(map[KEY]error)
+			}
+			errs[keys[i]] = err
+		}
+	}
+	return errs
+}
+
+type preEncoded struct {
+	msg interface{}
+	err error
+}
+
+// broadcast sends msg to every session and returns the errors in the same
+// order. Sessions whose codec comes from the same PreEncoder share one
+// encoded message, an encoder which is not comparable encodes msg for every
+// session.
+func broadcast(sessions []*Session, msg interface{}) []error {
+	errs := make([]error, len(sessions))
+	var frames map[PreEncoder]preEncoded
+	for i, session := range sessions {
+		out := msg
+		if codec, ok := session.codec.(PreEncoderCodec); ok {
+			if encoder := codec.PreEncoder(); encoder != nil {
+				// Value.Comparable needs Go 1.20.
+				if !reflect.ValueOf(encoder).Comparable() {
+					frame, err := encoder.PreEncode(msg)
+					if err != nil {
+						errs[i] = err
+						continue
+					}
+					errs[i] = session.Send(frame)
+					continue
+				}
+				if frames == nil {
+					frames = make(map[PreEncoder]preEncoded)
+				}
+				frame, exists := frames[encoder]
+				if !exists {
+					frame.msg, frame.err = encoder.PreEncode(msg)
+					frames[encoder] = frame
+				}
+				if frame.err != nil {
+					errs[i] = frame.err
+					continue
+				}
+				out = frame.msg
+			}
+		}
+		errs[i] = session.Send(out)
+	}
+	return errs
+}
+
 func (channel *Channel) Get(key KEY) *Session {
 	channel.mutex.RLock()
 	defer channel.mutex.RUnlock()
@@ -43,45 +147,120 @@ func (channel *Channel) Get(key KEY) *Session {
 
 func (channel *Channel) Put(key KEY, session *Session) {
 	channel.mutex.Lock()
-	defer channel.mutex.Unlock()
-	if session, exists := channel.sessions[key]; exists {
-		channel.remove(key, session)
+	old, exists := channel.sessions[key]
+	if exists {
+		if old == session {
+			channel.mutex.Unlock()
+			return
+		}
+		channel.remove(key, old)
 	}
 	session.AddCloseCallback(channel, key, func() {
-		channel.Remove(key)
+		channel.removeSession(key, session, ChannelLeaveClose)
 	})
+	session.join(channel, key)
 	channel.sessions[key] = session
+	channel.mutex.Unlock()
+
+	if exists {
+		channel.notify(ChannelEvent{ChannelLeaveReplace, key, old})
+	}
+	channel.notify(ChannelEvent{ChannelJoin, key, session})
 }
 
 func (channel *Channel) remove(key KEY, session *Session) {
 	session.RemoveCloseCallback(channel, key)
+	session.leave(channel, key)
 	delete(channel.sessions, key)
 }
 
+func (channel *Channel) removeSession(key KEY, session *Session, eventType ChannelEventType) bool {
+	channel.mutex.Lock()
+	if channel.sessions[key] != session {
+		channel.mutex.Unlock()
+		return false
+	}
+	channel.remove(key, session)
+	channel.mutex.Unlock()
+
+	channel.notify(ChannelEvent{eventType, key, session})
+	return true
+}
+
 func (channel *Channel) Remove(key KEY) bool {
 	channel.mutex.Lock()
-	defer channel.mutex.Unlock()
 	session, exists := channel.sessions[key]
 	if exists {
 		channel.remove(key, session)
 	}
+	channel.mutex.Unlock()
+
+	if exists {
+		channel.notify(ChannelEvent{ChannelLeaveRemove, key, session})
+	}
 	return exists
 }
 
 func (channel *Channel) FetchAndRemove(callback func(*Session)) {
 	channel.mutex.Lock()
-	defer channel.mutex.Unlock()
+	events := make([]ChannelEvent, 0, len(channel.sessions))
 	for key, session := range channel.sessions {
-		session.RemoveCloseCallback(channel, key)
-		delete(channel.sessions, key)
+		channel.remove(key, session)
 		callback(session)
+		events = append(events, ChannelEvent{ChannelLeaveRemove, key, session})
 	}
+	channel.mutex.Unlock()
+
+	channel.notify(events...)
 }
 
 func (channel *Channel) Close() {
 	channel.mutex.Lock()
-	defer channel.mutex.Unlock()
+	events := make([]ChannelEvent, 0, len(channel.sessions))
 	for key, session := range channel.sessions {
 		channel.remove(key, session)
+		events = append(events, ChannelEvent{ChannelLeaveRemove, key, session})
+	}
+	channel.mutex.Unlock()
+
+	channel.notify(events...)
+}
+
+func (channel *Channel) AddWatcher(key interface{}, watch func(ChannelEvent)) {
+	channel.watcherMutex.Lock()
+	defer channel.watcherMutex.Unlock()
+
+	watchers := make([]channelWatcher, len(channel.watchers), len(channel.watchers)+1)
+	copy(watchers, channel.watchers)
+	channel.watchers = append(watchers, channelWatcher{key, watch})
+}
+
+func (channel *Channel) RemoveWatcher(key interface{}) {
+	channel.watcherMutex.Lock()
+	defer channel.watcherMutex.Unlock()
+
+	watchers := make([]channelWatcher, 0, len(channel.watchers))
+	for _, watcher := range channel.watchers {
+		if watcher.key != key {
+			watchers = append(watchers, watcher)
+		}
+	}
+	channel.watchers = watchers
+}
+
+func (channel *Channel) watching() []channelWatcher {
+	channel.watcherMutex.Lock()
+	defer channel.watcherMutex.Unlock()
+	return channel.watchers
+}
+
+// notify runs outside of the channel lock, so watchers can call back into the
+// channel, e.g. to broadcast a join message to the other members.
+func (channel *Channel) notify(events ...ChannelEvent) {
+	watchers := channel.watching()
+	for _, event := range events {
+		for _, watcher := range watchers {
+			watcher.watch(event)
+		}
 	}
 }
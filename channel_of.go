@@ -0,0 +1,80 @@
+package link
+
+// ChannelOf is a Channel with typed keys and state. It wraps a plain Channel,
+// so locking and close handling are the same.
+type ChannelOf[K comparable, S any] struct {
+	channel *Channel
+
+	// channel state
+	State S
+}
+
+type ChannelEventOf[K comparable] struct {
+	Type    ChannelEventType
+	Key     K
+	Session *Session
+}
+
+func NewChannelOf[K comparable, S any]() *ChannelOf[K, S] {
+	return &ChannelOf[K, S]{
+		channel: NewChannel(),
+	}
+}
+
+func (channel *ChannelOf[K, S]) Channel() *Channel {
+	return channel.channel
+}
+
+func (channel *ChannelOf[K, S]) Len() int {
+	return channel.channel.Len()
+}
+
+func (channel *ChannelOf[K, S]) Fetch(callback func(*Session)) {
+	channel.channel.Fetch(callback)
+}
+
+func (channel *ChannelOf[K, S]) Broadcast(msg interface{}, filter func(*Session) bool) map[K]error {
+	var errs map[K]error
+	for key, err := range channel.channel.Broadcast(msg, filter) {
+		if errs == nil {
+			errs = make(map[K]error)
+		}
+		errs[key.(K)] = err
+	}
+	return errs
+}
+
+func (channel *ChannelOf[K, S]) Get(key K) *Session {
+	return channel.channel.Get(key)
+}
+
+func (channel *ChannelOf[K, S]) Put(key K, session *Session) {
+	channel.channel.Put(key, session)
+}
+
+func (channel *ChannelOf[K, S]) Remove(key K) bool {
+	return channel.channel.Remove(key)
+}
+
+func (channel *ChannelOf[K, S]) FetchAndRemove(callback func(*Session)) {
+	channel.channel.FetchAndRemove(callback)
+}
+
+func (channel *ChannelOf[K, S]) Close() {
+	channel.channel.Close()
+}
+
+func (channel *ChannelOf[K, S]) AddWatcher(key interface{}, watch func(ChannelEventOf[K])) {
+	channel.channel.AddWatcher(key, func(event ChannelEvent) {
+		watch(ChannelEventOf[K]{event.Type, event.Key.(K), event.Session})
+	})
+}
+
+func (channel *ChannelOf[K, S]) RemoveWatcher(key interface{}) {
+	channel.channel.RemoveWatcher(key)
+}
+
+func StateOf[T any](session *Session) (T, bool) {
+	state, ok := session.State.(T)
+	return state, ok
+}
@@ -0,0 +1,251 @@
+package link
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var ClientClosedError = errors.New("Client Closed")
+var ClientNotConnectedError = errors.New("Client Not Connected")
+
+type ClientState int
+
+const (
+	ClientConnecting ClientState = iota
+	ClientConnected
+	ClientDisconnected
+	ClientClosed
+)
+
+// Backoff doubles the delay between the dials from Min up to Max, Jitter in
+// [0, 1] randomizes every delay by that fraction. The zero Backoff is
+// DefaultBackoff.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+var DefaultBackoff = Backoff{
+	Min:    100 * time.Millisecond,
+	Max:    30 * time.Second,
+	Jitter: 0.2,
+}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b == (Backoff{}) {
+		b = DefaultBackoff
+	}
+	delay := b.Min
+	for i := 1; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	jitter := b.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		delay += time.Duration(float64(delay) * jitter * (rand.Float64()*2 - 1))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// Client keeps a session to a server, it dials again with backoff when the
+// session is closed and runs handshake on every new session before use.
+type Client struct {
+	dial      func() (*Session, error)
+	handshake func(*Session) error
+	backoff   Backoff
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	state    ClientState
+	session  *Session
+	watchers []clientWatcher
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+type clientWatcher struct {
+	key   interface{}
+	watch func(ClientState)
+}
+
+func NewClient(dial func() (*Session, error), handshake func(*Session) error, backoff Backoff) *Client {
+	client := &Client{
+		dial:      dial,
+		handshake: handshake,
+		backoff:   backoff,
+		closeChan: make(chan struct{}),
+	}
+	client.cond = sync.NewCond(&client.mutex)
+	go client.loop()
+	return client
+}
+
+func (client *Client) loop() {
+	attempt := 0
+	for {
+		client.setState(ClientConnecting, nil)
+
+		session, err := client.connect()
+		if err == nil {
+			attempt = 0
+			client.setState(ClientConnected, session)
+			select {
+			case <-session.closeChan:
+			case <-client.closeChan:
+				session.Close()
+			}
+		}
+
+		select {
+		case <-client.closeChan:
+			client.setState(ClientClosed, nil)
+			return
+		default:
+		}
+		client.setState(ClientDisconnected, nil)
+
+		attempt++
+		timer := time.NewTimer(client.backoff.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-client.closeChan:
+			timer.Stop()
+			client.setState(ClientClosed, nil)
+			return
+		}
+	}
+}
+
+func (client *Client) connect() (*Session, error) {
+	session, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	if client.handshake != nil {
+		if err := client.handshake(session); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+func (client *Client) setState(state ClientState, session *Session) {
+	client.mutex.Lock()
+	if client.state == state {
+		client.mutex.Unlock()
+		return
+	}
+	client.state = state
+	client.session = session
+	watchers := client.watchers
+	client.cond.Broadcast()
+	client.mutex.Unlock()
+
+	for _, watcher := range watchers {
+		watcher.watch(state)
+	}
+}
+
+func (client *Client) State() ClientState {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.state
+}
+
+func (client *Client) Session() *Session {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.session
+}
+
+func (client *Client) Wait() (*Session, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for client.state != ClientConnected && client.state != ClientClosed {
+		client.cond.Wait()
+	}
+	if client.state == ClientClosed {
+		return nil, ClientClosedError
+	}
+	return client.session, nil
+}
+
+func (client *Client) Send(msg interface{}) error {
+	client.mutex.Lock()
+	state, session := client.state, client.session
+	client.mutex.Unlock()
+
+	switch state {
+	case ClientConnected:
+		return session.Send(msg)
+	case ClientClosed:
+		return ClientClosedError
+	}
+	return ClientNotConnectedError
+}
+
+func (client *Client) Receive() (interface{}, error) {
+	for {
+		session, err := client.Wait()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := session.Receive()
+		if err == nil {
+			return msg, nil
+		}
+		client.waitChange(session)
+	}
+}
+
+func (client *Client) waitChange(session *Session) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for client.session == session && client.state == ClientConnected {
+		client.cond.Wait()
+	}
+}
+
+func (client *Client) Close() error {
+	err := ClientClosedError
+	client.closeOnce.Do(func() {
+		close(client.closeChan)
+		err = nil
+	})
+	return err
+}
+
+func (client *Client) AddWatcher(key interface{}, watch func(ClientState)) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	watchers := make([]clientWatcher, len(client.watchers), len(client.watchers)+1)
+	copy(watchers, client.watchers)
+	client.watchers = append(watchers, clientWatcher{key, watch})
+}
+
+func (client *Client) RemoveWatcher(key interface{}) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	watchers := make([]clientWatcher, 0, len(client.watchers))
+	for _, watcher := range client.watchers {
+		if watcher.key != key {
+			watchers = append(watchers, watcher)
+		}
+	}
+	client.watchers = watchers
+}
@@ -0,0 +1,184 @@
+package link
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func Test_Client(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil || string(msg.([]byte)) == "kick" {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	defer server.Stop()
+
+	addr := server.Listener().Addr().String()
+
+	var handshakes int32
+	client := NewClient(func() (*Session, error) {
+		return Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	}, func(session *Session) error {
+		atomic.AddInt32(&handshakes, 1)
+		return nil
+	}, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+
+	states := make(chan ClientState, 100)
+	client.AddWatcher(1, func(state ClientState) {
+		states <- state
+	})
+
+	for i := 0; i < 3; i++ {
+		session, err := client.Wait()
+		utest.IsNilNow(t, err)
+
+		msg := RandBytes(100)
+		utest.IsNilNow(t, session.Send(msg))
+		reply, err := client.Receive()
+		utest.IsNilNow(t, err)
+		utest.Assert(t, bytes.Equal(msg, reply.([]byte)))
+
+		utest.IsNilNow(t, client.Send([]byte("kick")))
+		_, err = session.Receive()
+		utest.NotNilNow(t, err)
+		for state := range states {
+			if state == ClientDisconnected {
+				break
+			}
+		}
+	}
+
+	_, err = client.Wait()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, atomic.LoadInt32(&handshakes), int32(4))
+
+	client.Close()
+	_, err = client.Receive()
+	utest.EqualNow(t, err, ClientClosedError)
+	utest.EqualNow(t, client.State(), ClientClosed)
+	utest.EqualNow(t, client.Send([]byte("x")), ClientClosedError)
+}
+
+func Test_BackoffDelay(t *testing.T) {
+	// The zero Backoff is DefaultBackoff.
+	for i := 0; i < 100; i++ {
+		delay := Backoff{}.Delay(1)
+		utest.Assert(t, delay >= 80*time.Millisecond && delay <= 120*time.Millisecond)
+	}
+	utest.Assert(t, Backoff{}.Delay(100) <= 36*time.Second)
+
+	// Jitter is clamped to 1, the delay never goes below 0.
+	b := Backoff{Min: 10 * time.Millisecond, Max: time.Second, Jitter: 5}
+	for i := 0; i < 100; i++ {
+		delay := b.Delay(1)
+		utest.Assert(t, delay >= 0 && delay <= 20*time.Millisecond)
+	}
+	utest.EqualNow(t, Backoff{Min: -time.Second, Max: time.Second}.Delay(1), time.Duration(0))
+}
+
+func Test_Pool(t *testing.T) {
+	server, err := Listen("tcp", "127.0.0.1:0", ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	defer server.Stop()
+
+	addr := server.Listener().Addr().String()
+
+	var dials int32
+	pool := NewPool(func() (*Session, error) {
+		atomic.AddInt32(&dials, 1)
+		return Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	}, 3, PoolRoundRobin)
+
+	seen := make(map[*Session]int)
+	for i := 0; i < 9; i++ {
+		session, err := pool.Get()
+		utest.IsNilNow(t, err)
+		seen[session]++
+	}
+	utest.EqualNow(t, len(seen), 3)
+	utest.EqualNow(t, pool.Len(), 3)
+	for _, n := range seen {
+		utest.EqualNow(t, n, 3)
+	}
+
+	for session := range seen {
+		session.Close()
+		break
+	}
+	utest.EqualNow(t, pool.Len(), 2)
+
+	session, err := pool.Get()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, seen[session], 0)
+	utest.EqualNow(t, atomic.LoadInt32(&dials), int32(4))
+
+	pool.HealthCheck(10*time.Millisecond, func(s *Session) error {
+		if s == session {
+			return ClientNotConnectedError
+		}
+		return nil
+	})
+	for !session.IsClosed() || pool.Len() < 3 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	utest.Assert(t, atomic.LoadInt32(&dials) >= 5)
+
+	pool.Close()
+	_, err = pool.Get()
+	utest.EqualNow(t, err, PoolClosedError)
+}
+
+func Test_PoolConcurrentGet(t *testing.T) {
+	var dials int32
+	pool := NewPool(func() (*Session, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(50 * time.Millisecond)
+		return NewSession(new(memoryCodec), 0), nil
+	}, 1, PoolRoundRobin)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	sessions := make([]*Session, 10)
+	for i := range sessions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session, err := pool.Get()
+			utest.IsNilNow(t, err)
+			sessions[i] = session
+		}(i)
+	}
+	wg.Wait()
+
+	utest.EqualNow(t, atomic.LoadInt32(&dials), int32(1))
+	utest.EqualNow(t, pool.Len(), 1)
+	for _, session := range sessions {
+		utest.Assert(t, session == sessions[0])
+	}
+}
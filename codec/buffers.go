@@ -0,0 +1,135 @@
+package codec
+
+import (
+	"io"
+	"net"
+
+	"github.com/funny/link/internal/vecio"
+)
+
+// BuffersWriter is implemented by the streams which write several buffers
+// at once, e.g. with writev, instead of copying them together first. The
+// buffers may be kept until the next Flush, so they must not be modified.
+type BuffersWriter interface {
+	WriteBuffers(buffers net.Buffers) (int64, error)
+}
+
+// writeBuffers writes buffers to w in one call when w supports it, the
+// buffers of a small payload are copied together for the other writers.
+func writeBuffers(w io.Writer, buffers net.Buffers) (int64, error) {
+	return vecio.Write(w, buffers)
+}
+
+// vectorThreshold is the size from which vecWriter keeps a reference to a
+// buffer given to WriteBuffers instead of copying it.
+const vectorThreshold = 512
+
+// vecWriter is a buffered writer like bufio.Writer. Small writes are copied
+// into its buffer, large buffers given to WriteBuffers are only referenced
+// and Flush writes everything in one writev. When w can not write several
+// buffers at once everything is copied into the buffer like bufio.Writer.
+type vecWriter struct {
+	w        io.Writer
+	vectored bool
+	buf      []byte
+	mark     int
+	pending  net.Buffers
+	err      error
+}
+
+func newVecWriter(w io.Writer, size int) *vecWriter {
+	return &vecWriter{
+		w:        w,
+		vectored: vecio.Vectored(w),
+		buf:      make([]byte, 0, size),
+	}
+}
+
+// reset drops the pending data and makes b write to w, the buffer is kept.
+func (b *vecWriter) reset(w io.Writer) {
+	for i := range b.pending {
+		b.pending[i] = nil
+	}
+	b.pending = b.pending[:0]
+	b.buf = b.buf[:0]
+	b.mark = 0
+	b.err = nil
+	b.w = w
+	b.vectored = vecio.Vectored(w)
+}
+
+func (b *vecWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(b.buf)+len(p) <= cap(b.buf) {
+		b.buf = append(b.buf, p...)
+		return len(p), nil
+	}
+	// p is not kept after return, it goes out with the pending data.
+	if len(p) >= cap(b.buf) {
+		if _, err := b.flush(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if err := b.Flush(); err != nil {
+		return 0, err
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *vecWriter) WriteBuffers(buffers net.Buffers) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	var n int64
+	for _, p := range buffers {
+		if !b.vectored || len(p) < vectorThreshold || len(b.buf)+len(p) <= cap(b.buf) {
+			if _, err := b.Write(p); err != nil {
+				return n, err
+			}
+		} else {
+			b.cut()
+			b.pending = append(b.pending, p)
+		}
+		n += int64(len(p))
+	}
+	return n, nil
+}
+
+// cut moves the bytes buffered since the last cut to the pending list.
+func (b *vecWriter) cut() {
+	if len(b.buf) > b.mark {
+		b.pending = append(b.pending, b.buf[b.mark:])
+		b.mark = len(b.buf)
+	}
+}
+
+func (b *vecWriter) Flush() error {
+	_, err := b.flush(nil)
+	return err
+}
+
+func (b *vecWriter) flush(extra []byte) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.cut()
+	if len(extra) > 0 {
+		b.pending = append(b.pending, extra)
+	}
+	if len(b.pending) == 0 {
+		return 0, nil
+	}
+	n, err := writeBuffers(b.w, b.pending)
+	for i := range b.pending {
+		b.pending[i] = nil
+	}
+	b.pending = b.pending[:0]
+	b.buf = b.buf[:0]
+	b.mark = 0
+	b.err = err
+	return n, err
+}
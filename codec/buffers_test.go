@@ -0,0 +1,116 @@
+package codec
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// vectorOutput is a destination which writes several buffers at once.
+type vectorOutput struct {
+	bytes.Buffer
+	writes int
+}
+
+func (o *vectorOutput) Write(p []byte) (int, error) {
+	o.writes++
+	return o.Buffer.Write(p)
+}
+
+func (o *vectorOutput) WriteBuffers(buffers net.Buffers) (int64, error) {
+	o.writes++
+	var n int64
+	for _, b := range buffers {
+		o.Buffer.Write(b)
+		n += int64(len(b))
+	}
+	return n, nil
+}
+
+// plainOutput counts the writes of a destination without vectored writes.
+type plainOutput struct {
+	bytes.Buffer
+	writes int
+}
+
+func (o *plainOutput) Write(p []byte) (int, error) {
+	o.writes++
+	return o.Buffer.Write(p)
+}
+
+func Test_VecWriter(t *testing.T) {
+	var out vectorOutput
+	w := newVecWriter(&out, 64)
+
+	large := bytes.Repeat([]byte("L"), 1024)
+	w.Write([]byte("head"))
+	w.WriteBuffers(net.Buffers{[]byte("h2"), large})
+	w.Write([]byte("tail"))
+	if out.Len() != 0 {
+		t.Fatalf("written before flush: %d", out.Len())
+	}
+
+	// The large buffer is referenced, not copied.
+	large[0] = 'X'
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expect := "headh2X" + string(large[1:]) + "tail"
+	if out.String() != expect {
+		t.Fatalf("output not match: %q", out.String())
+	}
+
+	// A large Write goes out with the buffered bytes.
+	out.Reset()
+	w.Write([]byte("a"))
+	w.Write(large)
+	if out.String() != "a"+string(large) {
+		t.Fatalf("output not match: %q", out.String())
+	}
+	w.Write(bytes.Repeat([]byte("b"), 40))
+	w.Write(bytes.Repeat([]byte("c"), 40))
+	if out.Len() != 1+len(large)+40 {
+		t.Fatalf("buffer full not flushed: %d", out.Len())
+	}
+}
+
+func Test_VecWriterMerge(t *testing.T) {
+	var out plainOutput
+	w := newVecWriter(&out, 64)
+
+	large := bytes.Repeat([]byte("L"), 1024)
+	w.Write([]byte("head"))
+	w.WriteBuffers(net.Buffers{[]byte("h2"), large})
+	w.Write([]byte("tail"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "headh2"+string(large)+"tail" {
+		t.Fatalf("output not match: %q", out.String())
+	}
+
+	// Without vectored writes the pieces go out in one Write.
+	out.Reset()
+	out.writes = 0
+	w.Write([]byte("a"))
+	w.Write(large)
+	if out.String() != "a"+string(large) || out.writes != 1 {
+		t.Fatalf("output not merged: %d writes", out.writes)
+	}
+
+	out.Reset()
+	out.writes = 0
+	n, err := writeBuffers(&out, net.Buffers{[]byte("head"), large})
+	if err != nil || n != int64(4+len(large)) || out.writes != 1 {
+		t.Fatalf("buffers not merged: %d, %v, %d writes", n, err, out.writes)
+	}
+
+	// A large payload is written piece by piece instead of copied.
+	out.Reset()
+	out.writes = 0
+	huge := bytes.Repeat([]byte("H"), 128*1024)
+	n, err = writeBuffers(&out, net.Buffers{[]byte("head"), huge})
+	if err != nil || n != int64(4+len(huge)) || out.writes != 2 {
+		t.Fatalf("large buffers: %d, %v, %d writes", n, err, out.writes)
+	}
+}
@@ -3,6 +3,10 @@ package codec
 import (
 	"bufio"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/funny/link"
 )
@@ -19,20 +23,23 @@ type bufioProtocol struct {
 	base     link.Protocol
 	readBuf  int
 	writeBuf int
+	readers  sync.Pool
+	writers  sync.Pool
 }
 
 func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
-	codec := new(bufioCodec)
+	codec := &bufioCodec{protocol: b}
 
 	if b.writeBuf > 0 {
-		codec.stream.w = bufio.NewWriterSize(rw, b.writeBuf)
+		codec.stream.w = b.getWriter(rw)
 		codec.stream.Writer = codec.stream.w
 	} else {
 		codec.stream.Writer = rw
 	}
 
 	if b.readBuf > 0 {
-		codec.stream.Reader = bufio.NewReaderSize(rw, b.readBuf)
+		codec.stream.r = b.getReader(rw)
+		codec.stream.Reader = codec.stream.r
 	} else {
 		codec.stream.Reader = rw
 	}
@@ -41,17 +48,49 @@ func (b *bufioProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 
 	codec.base, err = b.base.NewCodec(&codec.stream)
 	if err != nil {
+		codec.release()
 		return
 	}
 	cc = codec
 	return
 }
 
+func (b *bufioProtocol) getReader(rw io.Reader) *bufio.Reader {
+	if r, ok := b.readers.Get().(*bufio.Reader); ok {
+		r.Reset(rw)
+		return r
+	}
+	return bufio.NewReaderSize(rw, b.readBuf)
+}
+
+func (b *bufioProtocol) getWriter(rw io.Writer) *vecWriter {
+	if w, ok := b.writers.Get().(*vecWriter); ok {
+		w.reset(rw)
+		return w
+	}
+	return newVecWriter(rw, b.writeBuf)
+}
+
+func (b *bufioProtocol) PreEncode(msg interface{}) (interface{}, error) {
+	if encoder, ok := b.base.(link.PreEncoder); ok {
+		return encoder.PreEncode(msg)
+	}
+	return nil, ErrPreEncodeUnsupported
+}
+
 type bufioStream struct {
 	io.Reader
 	io.Writer
 	c io.Closer
-	w *bufio.Writer
+	r *bufio.Reader
+	w *vecWriter
+}
+
+func (s *bufioStream) WriteBuffers(buffers net.Buffers) (int64, error) {
+	if s.w != nil {
+		return s.w.WriteBuffers(buffers)
+	}
+	return writeBuffers(s.Writer, buffers)
 }
 
 func (s *bufioStream) Flush() error {
@@ -61,6 +100,13 @@ func (s *bufioStream) Flush() error {
 	return nil
 }
 
+func (s *bufioStream) SetDeadline(t time.Time) error {
+	if conn, ok := s.c.(deadliner); ok {
+		return conn.SetDeadline(t)
+	}
+	return errNoDeadline
+}
+
 func (s *bufioStream) close() error {
 	if s.c != nil {
 		return s.c.Close()
@@ -68,27 +114,111 @@ func (s *bufioStream) close() error {
 	return nil
 }
 
+// closedStream replaces the buffers returned to the pools.
+type closedStream struct{}
+
+func (closedStream) Read([]byte) (int, error)  { return 0, net.ErrClosed }
+func (closedStream) Write([]byte) (int, error) { return 0, net.ErrClosed }
+
+// bufioCodec returns its buffers to the pools of the protocol when it is
+// closed. A buffer still used by a Receive or a Send is returned by that
+// call when it exits.
 type bufioCodec struct {
-	base   link.Codec
-	stream bufioStream
+	base       link.Codec
+	stream     bufioStream
+	protocol   *bufioProtocol
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+	closed     int32
 }
 
 func (c *bufioCodec) Send(msg interface{}) error {
+	c.writeMutex.Lock()
+	defer c.unlockWrite()
 	if err := c.base.Send(msg); err != nil {
 		return err
 	}
 	return c.stream.Flush()
 }
 
+func (c *bufioCodec) SendBuffered(msg interface{}) error {
+	c.writeMutex.Lock()
+	defer c.unlockWrite()
+	return c.base.Send(msg)
+}
+
+func (c *bufioCodec) Flush() error {
+	c.writeMutex.Lock()
+	defer c.unlockWrite()
+	return c.stream.Flush()
+}
+
 func (c *bufioCodec) Receive() (interface{}, error) {
+	c.readMutex.Lock()
+	defer c.unlockRead()
 	return c.base.Receive()
 }
 
+func (c *bufioCodec) ReceiveFrames() error {
+	return receiveFrames(c.base)
+}
+
+func (c *bufioCodec) PreEncoder() link.PreEncoder {
+	return preEncoder(c.base)
+}
+
 func (c *bufioCodec) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
 	err1 := c.base.Close()
 	err2 := c.stream.close()
+	// Mutex.TryLock needs Go 1.18.
+	if c.readMutex.TryLock() {
+		c.releaseReader()
+		c.readMutex.Unlock()
+	}
+	if c.writeMutex.TryLock() {
+		c.releaseWriter()
+		c.writeMutex.Unlock()
+	}
 	if err1 != nil {
 		return err1
 	}
 	return err2
 }
+
+func (c *bufioCodec) unlockRead() {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		c.releaseReader()
+	}
+	c.readMutex.Unlock()
+}
+
+func (c *bufioCodec) unlockWrite() {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		c.releaseWriter()
+	}
+	c.writeMutex.Unlock()
+}
+
+func (c *bufioCodec) release() {
+	c.releaseReader()
+	c.releaseWriter()
+}
+
+func (c *bufioCodec) releaseReader() {
+	if c.stream.r != nil {
+		c.stream.r.Reset(nil)
+		c.protocol.readers.Put(c.stream.r)
+		c.stream.r = nil
+		c.stream.Reader = closedStream{}
+	}
+}
+
+func (c *bufioCodec) releaseWriter() {
+	if c.stream.w != nil {
+		c.stream.w.reset(nil)
+		c.protocol.writers.Put(c.stream.w)
+		c.stream.w = nil
+		c.stream.Writer = closedStream{}
+	}
+}
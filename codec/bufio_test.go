@@ -1,10 +1,72 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
 	"testing"
+
+	"github.com/funny/link"
 )
 
 func Test_Bufio(t *testing.T) {
-	JsonTest(t, Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 64*1024, 64*1024), 1024, 1024))
+	protocol := Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 64*1024, 64*1024), 1024, 1024)
+	JsonTest(t, protocol)
+	PreEncodeTest(t, protocol)
+	FrameTest(t, protocol)
+}
+
+func Test_BufioSendBuffered(t *testing.T) {
+	protocol := Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 64*1024, 64*1024), 1024, 1024)
+
+	var stream bytes.Buffer
+	codec, _ := protocol.NewCodec(&stream)
+	buffered := codec.(link.BufferedCodec)
+
+	for i := 0; i < 3; i++ {
+		if err := buffered.SendBuffered(&MyMessage1{"abc", i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("written before flush: %d", stream.Len())
+	}
+	if err := buffered.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		msg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.(*MyMessage1).Field2 != i {
+			t.Fatalf("message not match: %v", msg)
+		}
+	}
+}
+
+func Test_BufioReuse(t *testing.T) {
+	protocol := Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 64*1024, 64*1024), 1024, 1024)
+
+	for i := 0; i < 10; i++ {
+		var stream bytes.Buffer
+		codec, _ := protocol.NewCodec(&stream)
+		if err := codec.Send(&MyMessage1{"abc", i}); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := codec.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.(*MyMessage1).Field2 != i {
+			t.Fatalf("message not match: %v", msg)
+		}
+		codec.Close()
+
+		if err := codec.Send(&MyMessage1{"abc", i}); err == nil {
+			t.Fatal("send after close")
+		}
+		if _, err := codec.Receive(); err == nil {
+			t.Fatal("receive after close")
+		}
+	}
 }
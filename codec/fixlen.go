@@ -6,6 +6,8 @@ import (
 	"errors"
 	"io"
 	"math"
+	"net"
+	"sync"
 
 	"github.com/funny/link"
 )
@@ -13,6 +15,8 @@ import (
 var ErrTooLargePacket = errors.New("Too Large Packet")
 
 type FixLenProtocol struct {
+	bodyPool    sync.Pool
+	sendPool    sync.Pool
 	base        link.Protocol
 	n           int
 	maxRecv     int
@@ -21,6 +25,11 @@ type FixLenProtocol struct {
 	headEncoder func([]byte, int)
 }
 
+// FixLen prefixes every message of base with its size in n bytes. The base
+// codec reads a message body through an io.Reader which is emptied when its
+// Receive returns, so the body buffers can be pooled across connections: a
+// base message must copy the bytes it keeps, reading the reader later only
+// gives io.EOF.
 func FixLen(base link.Protocol, n int, byteOrder binary.ByteOrder, maxRecv, maxSend int) *FixLenProtocol {
 	proto := &FixLenProtocol{
 		n:    n,
@@ -96,9 +105,28 @@ func (p *FixLenProtocol) NewCodec(rw io.ReadWriter) (cc link.Codec, err error) {
 	return
 }
 
+func (p *FixLenProtocol) PreEncode(msg interface{}) (interface{}, error) {
+	encoder, ok := p.base.(link.PreEncoder)
+	if !ok {
+		return nil, ErrPreEncodeUnsupported
+	}
+	out, err := encoder.PreEncode(msg)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := out.(*Frame)
+	if !ok {
+		return nil, ErrPreEncodeUnsupported
+	}
+	data := body.Bytes()
+	head := make([]byte, p.n)
+	p.headEncoder(head, len(data))
+	return &Frame{protocol: p, head: head, data: data}, nil
+}
+
 type fixlenReadWriter struct {
 	recvBuf bytes.Reader
-	sendBuf bytes.Buffer
+	sendBuf *bytes.Buffer
 }
 
 func (rw *fixlenReadWriter) Read(p []byte) (int, error) {
@@ -113,8 +141,8 @@ type fixlenCodec struct {
 	base    link.Codec
 	head    [8]byte
 	headBuf []byte
-	bodyBuf []byte
 	rw      io.ReadWriter
+	frames  bool
 	*FixLenProtocol
 	fixlenReadWriter
 }
@@ -127,20 +155,47 @@ func (c *fixlenCodec) Receive() (interface{}, error) {
 	if size > c.maxRecv {
 		return nil, ErrTooLargePacket
 	}
-	if cap(c.bodyBuf) < size {
-		c.bodyBuf = make([]byte, size, size+128)
+	if c.frames {
+		// The frame outlives the call, it can not take a pooled buffer.
+		b := make([]byte, c.n+size)
+		copy(b, c.headBuf)
+		if _, err := io.ReadFull(c.rw, b[c.n:]); err != nil {
+			return nil, err
+		}
+		return &Frame{protocol: c.FixLenProtocol, head: b[:c.n], data: b[c.n:]}, nil
 	}
-	buff := c.bodyBuf[:size]
+	body := c.getBody(size)
+	defer c.putBody(body)
+	buff := (*body)[:size]
 	if _, err := io.ReadFull(c.rw, buff); err != nil {
 		return nil, err
 	}
 	c.recvBuf.Reset(buff)
 	msg, err := c.base.Receive()
+	c.recvBuf.Reset(nil)
 	return msg, err
 }
 
 func (c *fixlenCodec) Send(msg interface{}) error {
-	c.sendBuf.Reset()
+	if frame, ok := msg.(*Frame); ok {
+		if frame.protocol == c.FixLenProtocol {
+			_, err := writeBuffers(c.rw, frame.buffers())
+			return err
+		}
+		// A frame of the base protocol only needs the head.
+		if interface{}(frame.protocol) == interface{}(preEncoder(c.base)) && len(frame.head) == 0 {
+			head := make([]byte, c.n)
+			c.headEncoder(head, len(frame.data))
+			_, err := writeBuffers(c.rw, net.Buffers{head, frame.data})
+			return err
+		}
+		return ErrPreEncodeUnsupported
+	}
+	c.sendBuf = c.getSendBuf()
+	defer func() {
+		c.putSendBuf(c.sendBuf)
+		c.sendBuf = nil
+	}()
 	c.sendBuf.Write(c.headBuf)
 	err := c.base.Send(msg)
 	if err != nil {
@@ -152,6 +207,55 @@ func (c *fixlenCodec) Send(msg interface{}) error {
 	return err
 }
 
+// maxPooledBuffer is the largest buffer kept in the pools, the buffers of a
+// traffic spike are left to the GC so the pools shrink back.
+const maxPooledBuffer = 64 * 1024
+
+// The body and send buffers are only taken for one message, so an idle
+// connection holds no buffer.
+func (p *FixLenProtocol) getBody(size int) *[]byte {
+	if body, ok := p.bodyPool.Get().(*[]byte); ok {
+		if cap(*body) >= size {
+			return body
+		}
+		p.bodyPool.Put(body)
+	}
+	body := make([]byte, size, size+128)
+	return &body
+}
+
+func (p *FixLenProtocol) putBody(body *[]byte) {
+	if cap(*body) <= maxPooledBuffer {
+		p.bodyPool.Put(body)
+	}
+}
+
+func (p *FixLenProtocol) getSendBuf() *bytes.Buffer {
+	if buf, ok := p.sendPool.Get().(*bytes.Buffer); ok {
+		return buf
+	}
+	return new(bytes.Buffer)
+}
+
+func (p *FixLenProtocol) putSendBuf(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		buf.Reset()
+		p.sendPool.Put(buf)
+	}
+}
+
+func (c *fixlenCodec) ReceiveFrames() error {
+	c.frames = true
+	return nil
+}
+
+func (c *fixlenCodec) PreEncoder() link.PreEncoder {
+	if preEncoder(c.base) == nil {
+		return nil
+	}
+	return c.FixLenProtocol
+}
+
 func (c *fixlenCodec) Close() error {
 	if closer, ok := c.rw.(io.Closer); ok {
 		return closer.Close()
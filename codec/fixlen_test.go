@@ -1,12 +1,93 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"testing"
+
+	"github.com/funny/link"
 )
 
 func Test_FixLen(t *testing.T) {
 	base := JsonTestProtocol()
 	protocol := FixLen(base, 2, binary.LittleEndian, 1024, 1024)
 	JsonTest(t, protocol)
+	PreEncodeTest(t, protocol)
+	FrameTest(t, protocol)
+}
+
+func Test_FixLenBaseFrame(t *testing.T) {
+	base := JsonTestProtocol()
+	protocol := FixLen(base, 4, binary.BigEndian, 1024, 1024)
+
+	var stream1, stream2 bytes.Buffer
+	codec1, _ := protocol.NewCodec(&stream1)
+	codec2, _ := protocol.NewCodec(&stream2)
+
+	sendMsg := MyMessage1{"abc", 123}
+	frame, err := base.PreEncode(&sendMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := codec1.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := codec2.Send(&sendMsg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stream1.Bytes(), stream2.Bytes()) {
+		t.Fatalf("frame not match: %q, %q", stream1.Bytes(), stream2.Bytes())
+	}
+}
+
+// lazyProtocol returns the reader of the body as the message, like a
+// decoder which reads the message after Receive.
+type lazyProtocol struct{}
+
+func (lazyProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	return &lazyCodec{rw}, nil
+}
+
+type lazyCodec struct {
+	rw io.ReadWriter
+}
+
+func (c *lazyCodec) Receive() (interface{}, error) {
+	return c.rw, nil
+}
+
+func (c *lazyCodec) Send(msg interface{}) error {
+	_, err := c.rw.Write(msg.([]byte))
+	return err
+}
+
+func (c *lazyCodec) Close() error {
+	return nil
+}
+
+func Test_FixLenPooledBody(t *testing.T) {
+	protocol := FixLen(lazyProtocol{}, 2, binary.BigEndian, 1024, 1024)
+
+	var stream1, stream2 bytes.Buffer
+	codec1, _ := protocol.NewCodec(&stream1)
+	codec2, _ := protocol.NewCodec(&stream2)
+	codec1.Send([]byte("first"))
+	codec2.Send([]byte("other"))
+
+	msg1, err := codec1.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := codec2.Receive(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The body of codec1 went back to the pool, its reader is emptied so it
+	// never sees the body of codec2.
+	data, err := ioutil.ReadAll(msg1.(io.Reader))
+	if err != nil || len(data) != 0 {
+		t.Fatalf("pooled body leaked: %q, %v", data, err)
+	}
 }
@@ -0,0 +1,59 @@
+package codec
+
+import (
+	"errors"
+	"net"
+
+	"github.com/funny/link"
+)
+
+var ErrPreEncodeUnsupported = errors.New("Pre-Encode Unsupported")
+
+// Frame is a message encoded by a protocol's PreEncode method. Codecs created
+// by that protocol write the bytes directly, so one Frame can be sent to any
+// number of sessions without encoding the message again. The codecs of other
+// protocols fail with ErrPreEncodeUnsupported.
+type Frame struct {
+	protocol link.Protocol
+	head     []byte
+	data     []byte
+}
+
+func (f *Frame) Bytes() []byte {
+	if len(f.head) == 0 {
+		return f.data
+	}
+	b := make([]byte, 0, len(f.head)+len(f.data))
+	return append(append(b, f.head...), f.data...)
+}
+
+// buffers returns the frame without copying the head and the data together.
+func (f *Frame) buffers() net.Buffers {
+	if len(f.head) == 0 {
+		return net.Buffers{f.data}
+	}
+	return net.Buffers{f.head, f.data}
+}
+
+// FrameReceiver is implemented by the codecs which can receive the messages
+// without decoding them. After ReceiveFrames their Receive returns a *Frame,
+// the codecs of the same protocol send it as is, e.g. to forward messages.
+// ReceiveFrames fails with ErrPreEncodeUnsupported when the base codec of a
+// wrapper can not do it.
+type FrameReceiver interface {
+	ReceiveFrames() error
+}
+
+func receiveFrames(codec link.Codec) error {
+	if c, ok := codec.(FrameReceiver); ok {
+		return c.ReceiveFrames()
+	}
+	return ErrPreEncodeUnsupported
+}
+
+func preEncoder(codec link.Codec) link.PreEncoder {
+	if c, ok := codec.(link.PreEncoderCodec); ok {
+		return c.PreEncoder()
+	}
+	return nil
+}
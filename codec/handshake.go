@@ -0,0 +1,234 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/funny/link"
+)
+
+var ErrHandshakeTimeout = errors.New("Handshake Timeout")
+
+// HandshakeHello is sent by both sides of a connection:
+// [magic 4][version 2][min version 2][caps 4].
+type HandshakeHello struct {
+	Magic      [4]byte
+	Version    uint16
+	MinVersion uint16
+	Caps       uint32
+}
+
+const helloSize = 12
+
+func (h *HandshakeHello) writeTo(w io.Writer) error {
+	var b [helloSize]byte
+	copy(b[0:4], h.Magic[:])
+	binary.BigEndian.PutUint16(b[4:], h.Version)
+	binary.BigEndian.PutUint16(b[6:], h.MinVersion)
+	binary.BigEndian.PutUint32(b[8:], h.Caps)
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (h *HandshakeHello) readFrom(r io.Reader) error {
+	var b [helloSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	copy(h.Magic[:], b[0:4])
+	h.Version = binary.BigEndian.Uint16(b[4:])
+	h.MinVersion = binary.BigEndian.Uint16(b[6:])
+	h.Caps = binary.BigEndian.Uint32(b[8:])
+	return nil
+}
+
+// HandshakeError is returned by NewCodec when the peer is not compatible.
+type HandshakeError struct {
+	Reason string
+	Local  HandshakeHello
+	Remote HandshakeHello
+}
+
+func (e *HandshakeError) Error() string {
+	return "Handshake Failed: " + e.Reason
+}
+
+type HandshakeConfig struct {
+	Magic      [4]byte
+	Version    uint16
+	MinVersion uint16        // the oldest peer version accepted, 0 means Version
+	Caps       uint32        // capability flags of this side
+	Required   uint32        // capability flags the peer must have
+	Timeout    time.Duration // 0 means no limit
+}
+
+// Handshake exchanges a HandshakeHello with the peer before creating the base
+// codec. Both sides use the lower version of the two and the capabilities
+// they share, see Negotiated.
+func Handshake(base link.Protocol, config HandshakeConfig) link.Protocol {
+	if config.MinVersion == 0 {
+		config.MinVersion = config.Version
+	}
+	return &handshakeProtocol{
+		base:   base,
+		config: config,
+	}
+}
+
+type handshakeProtocol struct {
+	base   link.Protocol
+	config HandshakeConfig
+}
+
+func (p *handshakeProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	local := HandshakeHello{
+		Magic:      p.config.Magic,
+		Version:    p.config.Version,
+		MinVersion: p.config.MinVersion,
+		Caps:       p.config.Caps,
+	}
+
+	// The timeout uses the deadline of the stream, a stream without deadline
+	// is closed when the timeout expires.
+	var timer *time.Timer
+	if p.config.Timeout > 0 {
+		if conn, ok := rw.(deadliner); ok && conn.SetDeadline(time.Now().Add(p.config.Timeout)) == nil {
+			defer conn.SetDeadline(time.Time{})
+		} else if closer, ok := rw.(io.Closer); ok {
+			timer = time.AfterFunc(p.config.Timeout, func() {
+				closer.Close()
+			})
+		}
+	}
+
+	// Write while reading, a synchronous stream like net.Pipe would block
+	// both sides otherwise. A buffered stream is flushed, the peer waits for
+	// the hello too.
+	writeErr := make(chan error, 1)
+	go func() {
+		err := local.writeTo(rw)
+		if flusher, ok := rw.(interface{ Flush() error }); ok && err == nil {
+			err = flusher.Flush()
+		}
+		writeErr <- err
+	}()
+	var remote HandshakeHello
+	err := remote.readFrom(rw)
+	// The writer uses rw, wait for it before rw is given back.
+	if werr := <-writeErr; err == nil {
+		err = werr
+	}
+	if timer != nil && !timer.Stop() {
+		return nil, ErrHandshakeTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.check(&local, &remote); err != nil {
+		return nil, err
+	}
+
+	base, err := p.base.NewCodec(rw)
+	if err != nil {
+		return nil, err
+	}
+	version := local.Version
+	if remote.Version < version {
+		version = remote.Version
+	}
+	codec := &handshakeCodec{
+		base:    base,
+		version: version,
+		caps:    local.Caps & remote.Caps,
+	}
+	if buffered, ok := base.(link.BufferedCodec); ok {
+		return &bufferedHandshakeCodec{codec, buffered}, nil
+	}
+	return codec, nil
+}
+
+func (p *handshakeProtocol) check(local, remote *HandshakeHello) error {
+	var reason string
+	switch {
+	case remote.Magic != local.Magic:
+		reason = fmt.Sprintf("magic %q, expected %q", remote.Magic[:], local.Magic[:])
+	case remote.Version < local.MinVersion:
+		reason = fmt.Sprintf("peer version %d, expected %d or newer", remote.Version, local.MinVersion)
+	case local.Version < remote.MinVersion:
+		reason = fmt.Sprintf("peer requires version %d or newer, got %d", remote.MinVersion, local.Version)
+	case remote.Caps&p.config.Required != p.config.Required:
+		reason = fmt.Sprintf("peer capabilities %#x, required %#x", remote.Caps, p.config.Required)
+	default:
+		return nil
+	}
+	return &HandshakeError{reason, *local, *remote}
+}
+
+func (p *handshakeProtocol) PreEncode(msg interface{}) (interface{}, error) {
+	if encoder, ok := p.base.(link.PreEncoder); ok {
+		return encoder.PreEncode(msg)
+	}
+	return nil, ErrPreEncodeUnsupported
+}
+
+type handshakeCodec struct {
+	base    link.Codec
+	version uint16
+	caps    uint32
+}
+
+// Negotiated returns the version and the capabilities agreed by the handshake
+// of a codec created by a Handshake protocol.
+func Negotiated(codec link.Codec) (version uint16, caps uint32, ok bool) {
+	switch c := codec.(type) {
+	case *handshakeCodec:
+		return c.version, c.caps, true
+	case *bufferedHandshakeCodec:
+		return c.version, c.caps, true
+	}
+	return 0, 0, false
+}
+
+func (c *handshakeCodec) Send(msg interface{}) error {
+	return c.base.Send(msg)
+}
+
+func (c *handshakeCodec) Receive() (interface{}, error) {
+	return c.base.Receive()
+}
+
+func (c *handshakeCodec) Close() error {
+	return c.base.Close()
+}
+
+func (c *handshakeCodec) ReceiveFrames() error {
+	return receiveFrames(c.base)
+}
+
+func (c *handshakeCodec) PreEncoder() link.PreEncoder {
+	return preEncoder(c.base)
+}
+
+func (c *handshakeCodec) ClearSendChan(ch <-chan interface{}) {
+	if clear, ok := c.base.(link.ClearSendChan); ok {
+		clear.ClearSendChan(ch)
+	}
+}
+
+// bufferedHandshakeCodec keeps the batching of a BufferedCodec base.
+type bufferedHandshakeCodec struct {
+	*handshakeCodec
+	buffered link.BufferedCodec
+}
+
+func (c *bufferedHandshakeCodec) SendBuffered(msg interface{}) error {
+	return c.buffered.SendBuffered(msg)
+}
+
+func (c *bufferedHandshakeCodec) Flush() error {
+	return c.buffered.Flush()
+}
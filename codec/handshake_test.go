@@ -0,0 +1,194 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+)
+
+func handshakePair(client, server link.Protocol) (link.Codec, link.Codec, error, error) {
+	c1, c2 := net.Pipe()
+	type result struct {
+		codec link.Codec
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		codec, err := server.NewCodec(c2)
+		if err != nil {
+			c2.Close()
+		}
+		done <- result{codec, err}
+	}()
+	clientCodec, clientErr := client.NewCodec(c1)
+	if clientErr != nil {
+		c1.Close()
+	}
+	r := <-done
+	return clientCodec, r.codec, clientErr, r.err
+}
+
+func Test_Handshake(t *testing.T) {
+	base := JsonTestProtocol()
+	magic := [4]byte{'L', 'I', 'N', 'K'}
+
+	server := Handshake(base, HandshakeConfig{
+		Magic: magic, Version: 3, MinVersion: 2, Caps: 0x7, Required: 0x1,
+	})
+	client := Handshake(base, HandshakeConfig{
+		Magic: magic, Version: 2, Caps: 0x3,
+	})
+
+	clientCodec, serverCodec, err1, err2 := handshakePair(client, server)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	for _, codec := range []link.Codec{clientCodec, serverCodec} {
+		version, caps, ok := Negotiated(codec)
+		if !ok || version != 2 || caps != 0x3 {
+			t.Fatalf("negotiated: %v, %v, %v", version, caps, ok)
+		}
+	}
+	sendMsg := MyMessage1{"abc", 123}
+	go clientCodec.Send(&sendMsg)
+	recvMsg, err := serverCodec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendMsg != *(recvMsg.(*MyMessage1)) {
+		t.Fatalf("message not match: %v, %v", sendMsg, recvMsg)
+	}
+	clientCodec.Close()
+	serverCodec.Close()
+
+	incompatible := []link.Protocol{
+		Handshake(base, HandshakeConfig{Magic: [4]byte{'J', 'U', 'N', 'K'}, Version: 3, Caps: 0x1}),
+		Handshake(base, HandshakeConfig{Magic: magic, Version: 1, Caps: 0x1}),
+		Handshake(base, HandshakeConfig{Magic: magic, Version: 4, MinVersion: 4, Caps: 0x1}),
+		Handshake(base, HandshakeConfig{Magic: magic, Version: 3, Caps: 0x2}),
+	}
+	for i, client := range incompatible {
+		_, _, _, err := handshakePair(client, server)
+		if _, ok := err.(*HandshakeError); !ok {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func Test_HandshakeBuffered(t *testing.T) {
+	magic := [4]byte{'L', 'I', 'N', 'K'}
+	config := HandshakeConfig{Magic: magic, Version: 1, Caps: 0x1}
+
+	plain := Handshake(JsonTestProtocol(), config)
+	buffered := Handshake(Bufio(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 1024, 1024), 1024, 1024), config)
+
+	clientCodec, serverCodec, err1, err2 := handshakePair(plain, plain)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if _, ok := clientCodec.(link.BufferedCodec); ok {
+		t.Fatal("unbuffered base reported as BufferedCodec")
+	}
+	clientCodec.Close()
+	serverCodec.Close()
+
+	clientCodec, serverCodec, err1, err2 = handshakePair(buffered, buffered)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer clientCodec.Close()
+	defer serverCodec.Close()
+	if _, _, ok := Negotiated(clientCodec); !ok {
+		t.Fatal("not negotiated")
+	}
+	codec, ok := clientCodec.(link.BufferedCodec)
+	if !ok {
+		t.Fatal("BufferedCodec not forwarded")
+	}
+	if err := codec.SendBuffered(&MyMessage1{"abc", 1}); err != nil {
+		t.Fatal(err)
+	}
+	go codec.Flush()
+	msg, err := serverCodec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*MyMessage1).Field2 != 1 {
+		t.Fatalf("message not match: %v", msg)
+	}
+}
+
+func Test_HandshakeBufio(t *testing.T) {
+	magic := [4]byte{'L', 'I', 'N', 'K'}
+	config := HandshakeConfig{Magic: magic, Version: 1, Caps: 0x1, Timeout: 300 * time.Millisecond}
+	protocol := Bufio(Handshake(FixLen(JsonTestProtocol(), 2, binary.LittleEndian, 1024, 1024), config), 1024, 1024)
+
+	done := make(chan struct{})
+	var clientCodec, serverCodec link.Codec
+	var err1, err2 error
+	go func() {
+		clientCodec, serverCodec, err1, err2 = handshakePair(protocol, protocol)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handshake behind Bufio stuck")
+	}
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	defer clientCodec.Close()
+	defer serverCodec.Close()
+
+	go clientCodec.Send(&MyMessage1{"abc", 1})
+	msg, err := serverCodec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*MyMessage1).Field2 != 1 {
+		t.Fatalf("message not match: %v", msg)
+	}
+
+	// The timeout applies behind Bufio.
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	start := time.Now()
+	if _, err := protocol.NewCodec(c2); err == nil {
+		t.Fatal("silent peer accepted")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout not applied: %v", time.Since(start))
+	}
+}
+
+type closeOnlyStream struct {
+	io.Reader
+	io.Writer
+	closed chan struct{}
+}
+
+func (s *closeOnlyStream) Close() error {
+	close(s.closed)
+	return nil
+}
+
+func Test_HandshakeTimeoutWithoutDeadline(t *testing.T) {
+	r, w := io.Pipe()
+	stream := &closeOnlyStream{r, ioutil.Discard, make(chan struct{})}
+	go func() {
+		<-stream.closed
+		w.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	protocol := Handshake(JsonTestProtocol(), HandshakeConfig{Version: 1, Timeout: 100 * time.Millisecond})
+	if _, err := protocol.NewCodec(stream); err != ErrHandshakeTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package codec
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"reflect"
@@ -42,6 +43,7 @@ func (j *JsonProtocol) RegisterName(name string, t interface{}) {
 func (j *JsonProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
 	codec := &jsonCodec{
 		p:       j,
+		writer:  rw,
 		encoder: json.NewEncoder(rw),
 		decoder: json.NewDecoder(rw),
 	}
@@ -49,6 +51,27 @@ func (j *JsonProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
 	return codec, nil
 }
 
+func (j *JsonProtocol) PreEncode(msg interface{}) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(j.out(msg)); err != nil {
+		return nil, err
+	}
+	return &Frame{protocol: j, data: buf.Bytes()}, nil
+}
+
+func (j *JsonProtocol) out(msg interface{}) *jsonOut {
+	var out jsonOut
+	t := reflect.TypeOf(msg)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if name, exists := j.names[t]; exists {
+		out.Head = name
+	}
+	out.Body = msg
+	return &out
+}
+
 type jsonIn struct {
 	Head string
 	Body *json.RawMessage
@@ -62,11 +85,20 @@ type jsonOut struct {
 type jsonCodec struct {
 	p       *JsonProtocol
 	closer  io.Closer
+	writer  io.Writer
 	encoder *json.Encoder
 	decoder *json.Decoder
+	frames  bool
 }
 
 func (c *jsonCodec) Receive() (interface{}, error) {
+	if c.frames {
+		var raw json.RawMessage
+		if err := c.decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		return &Frame{protocol: c.p, data: append(raw, '\n')}, nil
+	}
 	var in jsonIn
 	err := c.decoder.Decode(&in)
 	if err != nil {
@@ -86,16 +118,23 @@ func (c *jsonCodec) Receive() (interface{}, error) {
 }
 
 func (c *jsonCodec) Send(msg interface{}) error {
-	var out jsonOut
-	t := reflect.TypeOf(msg)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-	if name, exists := c.p.names[t]; exists {
-		out.Head = name
+	if frame, ok := msg.(*Frame); ok {
+		if frame.protocol != c.p {
+			return ErrPreEncodeUnsupported
+		}
+		_, err := writeBuffers(c.writer, frame.buffers())
+		return err
 	}
-	out.Body = msg
-	return c.encoder.Encode(&out)
+	return c.encoder.Encode(c.p.out(msg))
+}
+
+func (c *jsonCodec) ReceiveFrames() error {
+	c.frames = true
+	return nil
+}
+
+func (c *jsonCodec) PreEncoder() link.PreEncoder {
+	return c.p
 }
 
 func (c *jsonCodec) Close() error {
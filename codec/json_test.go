@@ -105,7 +105,106 @@ func JsonTest(t *testing.T, protocol link.Protocol) {
 	}
 }
 
+func PreEncodeTest(t *testing.T, protocol link.Protocol) {
+	var stream1, stream2 bytes.Buffer
+
+	codec1, _ := protocol.NewCodec(&stream1)
+	codec2, _ := protocol.NewCodec(&stream2)
+
+	encoder := codec1.(link.PreEncoderCodec).PreEncoder()
+	if encoder == nil {
+		t.Fatal("codec can't pre-encode")
+	}
+
+	sendMsg := MyMessage1{
+		Field1: "abc",
+		Field2: 123,
+	}
+
+	frame, err := encoder.PreEncode(&sendMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := codec1.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := codec2.Send(&sendMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stream1.Bytes(), stream2.Bytes()) {
+		t.Fatalf("frame not match: %q, %q", stream1.Bytes(), stream2.Bytes())
+	}
+
+	recvMsg, err := codec1.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sendMsg != *(recvMsg.(*MyMessage1)) {
+		t.Fatalf("message not match: %v, %v", sendMsg, recvMsg)
+	}
+
+	// A frame of another protocol instance is refused.
+	foreign, err := JsonTestProtocol().PreEncode(&sendMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream3 bytes.Buffer
+	codec3, _ := protocol.NewCodec(&stream3)
+	if err := codec3.Send(foreign); err != ErrPreEncodeUnsupported {
+		t.Fatalf("foreign frame not refused: %v", err)
+	}
+	if stream3.Len() != 0 {
+		t.Fatalf("foreign frame written: %q", stream3.Bytes())
+	}
+}
+
+// FrameTest forwards a message received as a Frame to another codec of the
+// protocol, the bytes are written as they are received.
+func FrameTest(t *testing.T, protocol link.Protocol) {
+	var stream1, stream2 bytes.Buffer
+
+	sender, _ := protocol.NewCodec(&stream1)
+	sendMsg := MyMessage1{"abc", 123}
+	if err := sender.Send(&sendMsg); err != nil {
+		t.Fatal(err)
+	}
+	encoded := append([]byte(nil), stream1.Bytes()...)
+
+	forwarder, _ := protocol.NewCodec(&stream1)
+	if err := forwarder.(FrameReceiver).ReceiveFrames(); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := forwarder.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := frame.(*Frame); !ok {
+		t.Fatalf("frame not received: %#v", frame)
+	}
+
+	receiver, _ := protocol.NewCodec(&stream2)
+	if err := receiver.Send(frame); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stream2.Bytes(), encoded) {
+		t.Fatalf("frame not match: %q, %q", stream2.Bytes(), encoded)
+	}
+	recvMsg, err := receiver.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendMsg != *(recvMsg.(*MyMessage1)) {
+		t.Fatalf("message not match: %v, %v", sendMsg, recvMsg)
+	}
+}
+
 func Test_Json(t *testing.T) {
 	protocol := JsonTestProtocol()
 	JsonTest(t, protocol)
+	PreEncodeTest(t, protocol)
+	FrameTest(t, protocol)
 }
@@ -0,0 +1,201 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/funny/link"
+)
+
+var ErrUnknownProtocol = errors.New("Unknown Protocol")
+
+type sniffRule struct {
+	prefix   []byte
+	preamble bool
+	protocol link.Protocol
+}
+
+// SniffProtocol picks the protocol of every connection by the first bytes
+// the client sends. The longest matching rule wins, the fallback protocol is
+// used when no rule matches. NewCodec blocks until enough bytes are read to
+// decide, so it only suits protocols where the client speaks first.
+type SniffProtocol struct {
+	// Timeout limits the wait for the first bytes on the connections with
+	// SetDeadline, 0 means no limit.
+	Timeout time.Duration
+
+	fallback link.Protocol
+	rules    []sniffRule
+	maxLen   int
+}
+
+// Sniff creates a SniffProtocol, fallback may be nil to refuse the
+// connections no rule matches.
+func Sniff(fallback link.Protocol) *SniffProtocol {
+	return &SniffProtocol{
+		fallback: fallback,
+	}
+}
+
+// Match selects protocol when a connection starts with prefix, the prefix
+// is part of the protocol's own data, e.g. the '{' of JSON.
+func (s *SniffProtocol) Match(prefix []byte, protocol link.Protocol) *SniffProtocol {
+	return s.add(sniffRule{prefix, false, protocol})
+}
+
+// MatchPreamble selects protocol when a connection starts with preamble and
+// strips the preamble, the client side wraps protocol with Preamble.
+func (s *SniffProtocol) MatchPreamble(preamble []byte, protocol link.Protocol) *SniffProtocol {
+	return s.add(sniffRule{preamble, true, protocol})
+}
+
+func (s *SniffProtocol) add(rule sniffRule) *SniffProtocol {
+	rule.prefix = append([]byte(nil), rule.prefix...)
+	s.rules = append(s.rules, rule)
+	if len(rule.prefix) > s.maxLen {
+		s.maxLen = len(rule.prefix)
+	}
+	return s
+}
+
+func (s *SniffProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	conn, hasDeadline := rw.(deadliner)
+	hasDeadline = hasDeadline && s.Timeout > 0 && conn.SetDeadline(time.Now().Add(s.Timeout)) == nil
+	buf, match, err := s.sniff(rw)
+	if hasDeadline {
+		conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := s.fallback
+	if match != nil {
+		protocol = match.protocol
+		if match.preamble {
+			buf = buf[len(match.prefix):]
+		}
+	}
+	if protocol == nil {
+		return nil, ErrUnknownProtocol
+	}
+	return protocol.NewCodec(newSniffStream(rw, buf))
+}
+
+// sniff reads rw until a rule is decided.
+func (s *SniffProtocol) sniff(rw io.ReadWriter) ([]byte, *sniffRule, error) {
+	buf := make([]byte, 0, s.maxLen)
+	var match *sniffRule
+	for {
+		var pending bool
+		match, pending = s.match(buf)
+		if !pending {
+			break
+		}
+		n, err := rw.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err != nil {
+			match, _ = s.match(buf)
+			if match == nil {
+				return nil, nil, err
+			}
+			break
+		}
+	}
+	return buf, match, nil
+}
+
+// match returns the longest rule buf starts with, pending is true while a
+// longer rule may still match after more bytes are read.
+func (s *SniffProtocol) match(buf []byte) (match *sniffRule, pending bool) {
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if len(buf) < len(rule.prefix) {
+			if bytes.HasPrefix(rule.prefix, buf) {
+				pending = true
+			}
+		} else if bytes.HasPrefix(buf, rule.prefix) {
+			if match == nil || len(rule.prefix) > len(match.prefix) {
+				match = rule
+			}
+		}
+	}
+	return
+}
+
+// deadliner is implemented by the connections and by the streams wrapping
+// them, the streams return errNoDeadline when the connection has none.
+type deadliner interface {
+	SetDeadline(time.Time) error
+}
+
+var errNoDeadline = errors.New("Deadline Unsupported")
+
+// sniffStream replays the sniffed bytes before reading the connection. It
+// keeps the deadlines and the vectored writes of the connection.
+type sniffStream struct {
+	io.Reader
+	io.Writer
+	c io.Closer
+}
+
+func newSniffStream(rw io.ReadWriter, sniffed []byte) io.ReadWriter {
+	if len(sniffed) == 0 {
+		return rw
+	}
+	stream := &sniffStream{
+		Reader: io.MultiReader(bytes.NewReader(sniffed), rw),
+		Writer: rw,
+	}
+	stream.c, _ = rw.(io.Closer)
+	return stream
+}
+
+func (s *sniffStream) WriteBuffers(buffers net.Buffers) (int64, error) {
+	return writeBuffers(s.Writer, buffers)
+}
+
+func (s *sniffStream) SetDeadline(t time.Time) error {
+	if conn, ok := s.Writer.(deadliner); ok {
+		return conn.SetDeadline(t)
+	}
+	return errNoDeadline
+}
+
+func (s *sniffStream) Close() error {
+	if s.c != nil {
+		return s.c.Close()
+	}
+	return nil
+}
+
+// Preamble writes preamble on every new connection before handing it to
+// base, it is the client side of SniffProtocol.MatchPreamble.
+func Preamble(preamble []byte, base link.Protocol) link.Protocol {
+	return &preambleProtocol{
+		preamble: append([]byte(nil), preamble...),
+		base:     base,
+	}
+}
+
+type preambleProtocol struct {
+	preamble []byte
+	base     link.Protocol
+}
+
+func (p *preambleProtocol) NewCodec(rw io.ReadWriter) (link.Codec, error) {
+	if _, err := rw.Write(p.preamble); err != nil {
+		return nil, err
+	}
+	return p.base.NewCodec(rw)
+}
+
+func (p *preambleProtocol) PreEncode(msg interface{}) (interface{}, error) {
+	if encoder, ok := p.base.(link.PreEncoder); ok {
+		return encoder.PreEncode(msg)
+	}
+	return nil, ErrPreEncodeUnsupported
+}
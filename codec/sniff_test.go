@@ -0,0 +1,110 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+)
+
+// sniffTest sends a message with the client protocol and receives it on a
+// codec created by the server protocol.
+func sniffTest(t *testing.T, client, server link.Protocol, expect link.Protocol) {
+	var stream bytes.Buffer
+
+	clientCodec, err := client.NewCodec(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMsg := MyMessage1{"abc", 123}
+	if err := clientCodec.Send(&sendMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	serverCodec, err := server.NewCodec(&stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := serverCodec.(link.PreEncoderCodec); ok {
+		if interface{}(c.PreEncoder()) != interface{}(expect) {
+			t.Fatalf("protocol not match: %#v", c.PreEncoder())
+		}
+	}
+	recvMsg, err := serverCodec.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendMsg != *(recvMsg.(*MyMessage1)) {
+		t.Fatalf("message not match: %v, %v", sendMsg, recvMsg)
+	}
+}
+
+func Test_Sniff(t *testing.T) {
+	base := JsonTestProtocol()
+	v1 := FixLen(base, 2, binary.BigEndian, 1024, 1024)
+	v2 := FixLen(base, 4, binary.BigEndian, 1024, 1024)
+
+	server := Sniff(v1).
+		Match([]byte("{"), base).
+		MatchPreamble([]byte("LINK/2"), v2)
+
+	sniffTest(t, v1, server, v1)
+	sniffTest(t, base, server, base)
+	sniffTest(t, Preamble([]byte("LINK/2"), v2), server, v2)
+
+	// The longest rule wins.
+	v3 := FixLen(base, 4, binary.LittleEndian, 1024, 1024)
+	server.MatchPreamble([]byte("LINK/2.1"), v3)
+	sniffTest(t, Preamble([]byte("LINK/2.1"), v3), server, v3)
+	sniffTest(t, Preamble([]byte("LINK/2"), v2), server, v2)
+
+	var stream bytes.Buffer
+	stream.WriteString("\x00\x00\x00\x00")
+	if _, err := Sniff(nil).Match([]byte("{"), base).NewCodec(&stream); err != ErrUnknownProtocol {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func Test_SniffTimeout(t *testing.T) {
+	base := JsonTestProtocol()
+	server := Sniff(base).Match([]byte("{"), base)
+	server.Timeout = 100 * time.Millisecond
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	start := time.Now()
+	if _, err := server.NewCodec(c2); err == nil {
+		t.Fatal("silent client accepted")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout not applied: %v", time.Since(start))
+	}
+}
+
+func Test_SniffStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	stream := newSniffStream(c2, []byte("{"))
+	if _, ok := stream.(BuffersWriter); !ok {
+		t.Fatal("WriteBuffers not forwarded")
+	}
+	conn, ok := stream.(deadliner)
+	if !ok {
+		t.Fatal("SetDeadline not forwarded")
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	buf := make([]byte, 2)
+	if n, err := stream.Read(buf); n != 1 || err != nil {
+		t.Fatalf("sniffed bytes not replayed: %d, %v", n, err)
+	}
+	if _, err := stream.Read(buf); err == nil {
+		t.Fatal("deadline not set on the connection")
+	}
+}
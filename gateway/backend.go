@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/mux"
+)
+
+var ErrNotForwarded = errors.New("Gateway Session Not Forwarded")
+
+const identityTimeout = 10 * time.Second
+
+// Conn is a client connection forwarded by a Frontend.
+type Conn struct {
+	net.Conn
+	identity []byte
+}
+
+// Identity returns the identity given by the Route of the client.
+func (c *Conn) Identity() []byte {
+	return c.identity
+}
+
+// Backend accepts the connections of the Frontends and returns every
+// forwarded client as a Conn, so a link.Server on it sees ordinary sessions.
+// Backend is also a link.Authenticator, with Server.SetAuthenticator the
+// Session.Identity of a forwarded session returns its identity as a []byte.
+type Backend struct {
+	base net.Listener
+
+	mutex sync.Mutex
+	muxes map[*mux.Mux]struct{}
+
+	acceptChan chan *Conn
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+func ListenBackend(network, address string) (*Backend, error) {
+	base, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewBackend(base), nil
+}
+
+func NewBackend(base net.Listener) *Backend {
+	b := &Backend{
+		base:       base,
+		muxes:      make(map[*mux.Mux]struct{}),
+		acceptChan: make(chan *Conn),
+		closeChan:  make(chan struct{}),
+	}
+	go b.acceptLoop()
+	return b
+}
+
+func (b *Backend) acceptLoop() {
+	for {
+		conn, err := link.Accept(b.base)
+		if err != nil {
+			b.close(err)
+			return
+		}
+		m := mux.Server(conn)
+		b.mutex.Lock()
+		if b.muxes == nil {
+			b.mutex.Unlock()
+			m.Close()
+			continue
+		}
+		b.muxes[m] = struct{}{}
+		b.mutex.Unlock()
+		go b.serve(m)
+	}
+}
+
+func (b *Backend) serve(m *mux.Mux) {
+	defer func() {
+		b.mutex.Lock()
+		delete(b.muxes, m)
+		b.mutex.Unlock()
+		m.Close()
+	}()
+	for {
+		stream, err := m.Accept()
+		if err != nil {
+			return
+		}
+		go b.handshake(stream)
+	}
+}
+
+func (b *Backend) handshake(stream net.Conn) {
+	stream.SetReadDeadline(time.Now().Add(identityTimeout))
+	identity, err := readIdentity(stream)
+	if err != nil {
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	select {
+	case b.acceptChan <- &Conn{stream, identity}:
+	case <-b.closeChan:
+		stream.Close()
+	}
+}
+
+func (b *Backend) Accept() (net.Conn, error) {
+	select {
+	case conn := <-b.acceptChan:
+		return conn, nil
+	case <-b.closeChan:
+		return nil, b.err
+	}
+}
+
+// Close stops accepting and closes the connections of the Frontends.
+func (b *Backend) Close() error {
+	return b.close(net.ErrClosed)
+}
+
+func (b *Backend) close(reason error) error {
+	err := net.ErrClosed
+	b.closeOnce.Do(func() {
+		b.err = reason
+		close(b.closeChan)
+		err = b.base.Close()
+
+		b.mutex.Lock()
+		muxes := b.muxes
+		b.muxes = nil
+		b.mutex.Unlock()
+		for m := range muxes {
+			m.Close()
+		}
+	})
+	return err
+}
+
+var _ link.Authenticator = (*Backend)(nil)
+
+func (b *Backend) Authenticate(session *link.Session) (interface{}, error) {
+	conn, ok := session.Conn().(*Conn)
+	if !ok {
+		return nil, ErrNotForwarded
+	}
+	return conn.identity, nil
+}
+
+func (b *Backend) Addr() net.Addr {
+	return b.base.Addr()
+}
+
+func readIdentity(r io.Reader) ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	identity := make([]byte, binary.BigEndian.Uint16(head[:]))
+	if _, err := io.ReadFull(r, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
@@ -0,0 +1,208 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/funny/link/mux"
+)
+
+var ErrFrontendClosed = errors.New("Gateway Frontend Closed")
+
+const maxIdentitySize = 0xFFFF
+
+// Route is the identity returned by the link.Authenticator of the Server
+// which runs a Frontend: the address of the backend which serves the client
+// and the identity the backend sees on the forwarded session.
+type Route struct {
+	Backend  string
+	Identity []byte
+}
+
+// Frontend is a link.Handler. It forwards the messages of the client sessions
+// to the backends given by their Route, all the clients of one backend share
+// one multiplexed connection. The sessions without a Route are closed.
+type Frontend struct {
+	protocol     link.Protocol
+	sendChanSize int
+	dial         func(backend string) (net.Conn, error)
+
+	mutex   sync.Mutex
+	links   map[string]*mux.Mux
+	dialing map[string]*linkDial
+	closed  bool
+}
+
+// linkDial is a backend dial in flight, the logins to the backend wait for it.
+type linkDial struct {
+	done chan struct{}
+	link *mux.Mux
+	err  error
+}
+
+// NewFrontend creates a Frontend which talks to the backends with protocol.
+// dial may be nil to connect the backends over TCP.
+func NewFrontend(protocol link.Protocol, sendChanSize int, dial func(backend string) (net.Conn, error)) *Frontend {
+	if dial == nil {
+		dial = func(backend string) (net.Conn, error) {
+			return net.DialTimeout("tcp", backend, 10*time.Second)
+		}
+	}
+	return &Frontend{
+		protocol:     protocol,
+		sendChanSize: sendChanSize,
+		dial:         dial,
+		links:        make(map[string]*mux.Mux),
+		dialing:      make(map[string]*linkDial),
+	}
+}
+
+func (f *Frontend) HandleSession(session *link.Session) {
+	defer session.Close()
+
+	route, ok := session.Identity().(*Route)
+	if !ok || len(route.Identity) > maxIdentitySize {
+		return
+	}
+
+	backendSession, err := f.open(route.Backend, route.Identity)
+	if err != nil {
+		return
+	}
+	defer backendSession.Close()
+	receiveFrames(session, backendSession)
+
+	go func() {
+		defer session.Close()
+		forward(backendSession, session)
+	}()
+	forward(session, backendSession)
+}
+
+// receiveFrames makes the two sessions forward the messages without decoding
+// them when their codecs come from one protocol.
+func receiveFrames(client, backend *link.Session) {
+	c1, ok1 := client.Codec().(link.PreEncoderCodec)
+	c2, ok2 := backend.Codec().(link.PreEncoderCodec)
+	if !ok1 || !ok2 || c1.PreEncoder() == nil || c1.PreEncoder() != c2.PreEncoder() {
+		return
+	}
+	r1, ok1 := client.Codec().(codec.FrameReceiver)
+	r2, ok2 := backend.Codec().(codec.FrameReceiver)
+	if !ok1 || !ok2 {
+		return
+	}
+	if r1.ReceiveFrames() == nil {
+		r2.ReceiveFrames()
+	}
+}
+
+// forward sends the messages received from src to dst until one of them fails.
+func forward(src, dst *link.Session) {
+	for {
+		msg, err := src.Receive()
+		if err != nil {
+			return
+		}
+		if err := dst.Send(msg); err != nil {
+			return
+		}
+	}
+}
+
+func (f *Frontend) open(backend string, identity []byte) (*link.Session, error) {
+	m, err := f.link(backend)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := m.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeIdentity(stream, identity); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	codec, err := f.protocol.NewCodec(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return link.NewSession(codec, f.sendChanSize), nil
+}
+
+// link returns the connection to backend, a broken one is dialed again.
+// The dial runs without the lock, concurrent logins to one backend share it.
+func (f *Frontend) link(backend string) (*mux.Mux, error) {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil, ErrFrontendClosed
+	}
+	if m, exists := f.links[backend]; exists {
+		if m.Err() == nil {
+			f.mutex.Unlock()
+			return m, nil
+		}
+		delete(f.links, backend)
+	}
+	if d, exists := f.dialing[backend]; exists {
+		f.mutex.Unlock()
+		<-d.done
+		return d.link, d.err
+	}
+	d := &linkDial{done: make(chan struct{})}
+	f.dialing[backend] = d
+	f.mutex.Unlock()
+
+	conn, err := f.dial(backend)
+
+	f.mutex.Lock()
+	delete(f.dialing, backend)
+	if err == nil {
+		if f.closed {
+			conn.Close()
+			err = ErrFrontendClosed
+		} else {
+			d.link = mux.Client(conn)
+			f.links[backend] = d.link
+		}
+	}
+	d.err = err
+	f.mutex.Unlock()
+	close(d.done)
+	return d.link, d.err
+}
+
+func (f *Frontend) NumLinks() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.links)
+}
+
+// Close closes the backend connections, the forwarded sessions are closed
+// with them.
+func (f *Frontend) Close() {
+	f.mutex.Lock()
+	links := f.links
+	f.links = nil
+	f.closed = true
+	f.mutex.Unlock()
+
+	for _, m := range links {
+		m.Close()
+	}
+}
+
+func writeIdentity(conn net.Conn, identity []byte) error {
+	b := make([]byte, 2+len(identity))
+	binary.BigEndian.PutUint16(b, uint16(len(identity)))
+	copy(b[2:], identity)
+	_, err := conn.Write(b)
+	return err
+}
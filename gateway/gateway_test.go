@@ -0,0 +1,193 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/funny/utest"
+)
+
+type Login struct {
+	Name    string
+	Backend string
+}
+
+type Chat struct {
+	Text string
+}
+
+func newBackend(t *testing.T, protocol link.Protocol) *link.Server {
+	backend, err := ListenBackend("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+
+	server := link.NewServer(backend, protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		identity := session.Identity().([]byte)
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			text := fmt.Sprintf("%s@%s: %s", identity, session.Conn().LocalAddr(), msg.(*Chat).Text)
+			if err := session.Send(&Chat{text}); err != nil {
+				return
+			}
+		}
+	}))
+	server.SetAuthenticator(backend, 0)
+	go server.Serve()
+	return server
+}
+
+func Test_Gateway(t *testing.T) {
+	protocol := codec.Json()
+	protocol.Register(Login{})
+	protocol.Register(Chat{})
+
+	backend1 := newBackend(t, protocol)
+	defer backend1.Stop()
+	backend2 := newBackend(t, protocol)
+	defer backend2.Stop()
+
+	var dials int32
+	frontend := NewFrontend(protocol, 0, func(backend string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial("tcp", backend)
+	})
+	defer frontend.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	server := link.NewServer(listener, protocol, 0, frontend)
+	server.SetAuthenticator(link.AuthenticatorFunc(func(session *link.Session) (interface{}, error) {
+		msg, err := session.Receive()
+		if err != nil {
+			return nil, err
+		}
+		login, ok := msg.(*Login)
+		if !ok || login.Name == "" {
+			return nil, errors.New("bad login")
+		}
+		return &Route{login.Backend, []byte(login.Name)}, nil
+	}), time.Second)
+	go server.Serve()
+	defer server.Stop()
+
+	backends := []string{
+		backend1.Listener().Addr().String(),
+		backend2.Listener().Addr().String(),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session, err := link.Dial("tcp", listener.Addr().String(), protocol, 0)
+			utest.IsNilNow(t, err)
+			defer session.Close()
+
+			name := fmt.Sprintf("player%d", i)
+			backend := backends[i%2]
+			utest.IsNilNow(t, session.Send(&Login{name, backend}))
+			for j := 0; j < 10; j++ {
+				utest.IsNilNow(t, session.Send(&Chat{fmt.Sprint(j)}))
+				msg, err := session.Receive()
+				utest.IsNilNow(t, err)
+				utest.EqualNow(t, msg.(*Chat).Text, fmt.Sprintf("%s@%s: %d", name, backend, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	utest.EqualNow(t, frontend.NumLinks(), 2)
+	utest.EqualNow(t, atomic.LoadInt32(&dials), int32(2))
+
+	// A failed login closes the client session.
+	session, err := link.Dial("tcp", listener.Addr().String(), protocol, 0)
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, session.Send(&Chat{"hello"}))
+	_, err = session.Receive()
+	utest.NotNilNow(t, err)
+}
+
+func Test_FrontendSlowDial(t *testing.T) {
+	release := make(chan struct{})
+	var slowDials int32
+	frontend := NewFrontend(codec.Json(), 0, func(backend string) (net.Conn, error) {
+		if backend == "slow" {
+			atomic.AddInt32(&slowDials, 1)
+			<-release
+			return nil, errors.New("unreachable")
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	defer frontend.Close()
+
+	var wg sync.WaitGroup
+	var started int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt32(&started, 1)
+			_, err := frontend.link("slow")
+			utest.NotNilNow(t, err)
+		}()
+	}
+	for atomic.LoadInt32(&slowDials) == 0 || atomic.LoadInt32(&started) < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Other backends are not blocked by the dial in flight.
+	_, err := frontend.link("fast")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, frontend.NumLinks(), 1)
+
+	close(release)
+	wg.Wait()
+	utest.EqualNow(t, atomic.LoadInt32(&slowDials), int32(1))
+}
+
+func Test_FrontendFrames(t *testing.T) {
+	pair := func(p1, p2 link.Protocol) (*link.Session, *link.Session, net.Conn) {
+		c1, c2 := net.Pipe()
+		codec1, err := p1.NewCodec(c1)
+		utest.IsNilNow(t, err)
+		codec2, err := p2.NewCodec(c2)
+		utest.IsNilNow(t, err)
+		return link.NewSession(codec1, 0), link.NewSession(codec2, 0), c2
+	}
+	protocol := codec.Json()
+	protocol.Register(Chat{})
+
+	// One protocol on both sides, the messages are forwarded as frames.
+	client, backend, peer := pair(protocol, protocol)
+	defer client.Close()
+	defer backend.Close()
+	receiveFrames(client, backend)
+	go peer.Write([]byte("{\"Head\":\"\",\"Body\":1}\n"))
+	msg, err := client.Receive()
+	utest.IsNilNow(t, err)
+	_, ok := msg.(*codec.Frame)
+	utest.Assert(t, ok)
+
+	// The frames of another protocol can not be sent, they are decoded.
+	client, backend, peer = pair(protocol, codec.Json())
+	defer client.Close()
+	defer backend.Close()
+	receiveFrames(client, backend)
+	go peer.Write([]byte("{\"Head\":\"\",\"Body\":1}\n"))
+	msg, err = client.Receive()
+	utest.IsNilNow(t, err)
+	_, ok = msg.(*codec.Frame)
+	utest.Assert(t, !ok)
+}
@@ -0,0 +1,89 @@
+package link
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type IDGenerator interface {
+	NextID() uint64
+}
+
+type IDGeneratorFunc func() uint64
+
+func (f IDGeneratorFunc) NextID() uint64 {
+	return f()
+}
+
+var globalSessionId uint64
+
+var counterID = IDGeneratorFunc(func() uint64 {
+	return atomic.AddUint64(&globalSessionId, 1)
+})
+
+func RandomID() IDGenerator {
+	return IDGeneratorFunc(func() uint64 {
+		var b [8]byte
+		for {
+			if _, err := rand.Read(b[:]); err != nil {
+				panic(err)
+			}
+			if id := binary.LittleEndian.Uint64(b[:]); id != 0 {
+				return id
+			}
+		}
+	})
+}
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeMaxNode  = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq   = 1<<snowflakeSeqBits - 1
+)
+
+var snowflakeEpoch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type snowflake struct {
+	mutex sync.Mutex
+	node  uint64
+	last  int64
+	seq   uint64
+}
+
+// Snowflake returns a generator of 41 bits millisecond timestamp, 10 bits node
+// ID and 12 bits sequence. IDs are unique across processes as long as every
+// process uses a different node ID.
+func Snowflake(node uint64) IDGenerator {
+	if node > snowflakeMaxNode {
+		panic("link: snowflake node id out of range")
+	}
+	return &snowflake{node: node}
+}
+
+func (s *snowflake) NextID() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Since(snowflakeEpoch).Nanoseconds() / int64(time.Millisecond)
+	if now < s.last {
+		now = s.last
+	}
+	if now == s.last {
+		s.seq = (s.seq + 1) & snowflakeMaxSeq
+		if s.seq == 0 {
+			for now <= s.last {
+				time.Sleep(100 * time.Microsecond)
+				now = time.Since(snowflakeEpoch).Nanoseconds() / int64(time.Millisecond)
+			}
+		}
+	} else {
+		s.seq = 0
+	}
+	s.last = now
+
+	return uint64(now)<<(snowflakeNodeBits+snowflakeSeqBits) | s.node<<snowflakeSeqBits | s.seq
+}
@@ -0,0 +1,63 @@
+// Package vecio writes several buffers at once for the codecs and the
+// connection wrappers of link.
+package vecio
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Writer is implemented by the streams which write several buffers at once.
+type Writer interface {
+	WriteBuffers(buffers net.Buffers) (int64, error)
+}
+
+// Vectored reports whether w writes several buffers at once. net.Buffers
+// uses writev on the TCP and unix connections.
+func Vectored(w io.Writer) bool {
+	switch w.(type) {
+	case Writer, *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// maxMerge is the largest payload copied together for a writer without
+// vectored writes, larger ones are written piece by piece.
+const maxMerge = 64 * 1024
+
+var scratchPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// Write writes buffers to w in one call. The buffers are copied together
+// into a pooled scratch buffer for the other writers, so a TLS or WebSocket
+// connection sends one record.
+func Write(w io.Writer, buffers net.Buffers) (int64, error) {
+	if bw, ok := w.(Writer); ok {
+		return bw.WriteBuffers(buffers)
+	}
+	if len(buffers) == 1 || Vectored(w) {
+		return buffers.WriteTo(w)
+	}
+	size := 0
+	for _, b := range buffers {
+		size += len(b)
+	}
+	if size > maxMerge {
+		return buffers.WriteTo(w)
+	}
+	scratch := scratchPool.Get().(*[]byte)
+	merged := (*scratch)[:0]
+	for _, b := range buffers {
+		merged = append(merged, b...)
+	}
+	n, err := w.Write(merged)
+	*scratch = merged[:0]
+	scratchPool.Put(scratch)
+	return int64(n), err
+}
@@ -2,9 +2,13 @@ package link
 
 import "sync"
 
-const sessionMapNum = 32
+const (
+	sessionMapBits = 5
+	sessionMapNum  = 1 << sessionMapBits
+)
 
 type Manager struct {
+	ids         IDGenerator
 	sessionMaps [sessionMapNum]sessionMap
 	disposeOnce sync.Once
 	disposeWait sync.WaitGroup
@@ -24,6 +28,18 @@ func NewManager() *Manager {
 	return manager
 }
 
+// SetIDGenerator replaces the default process wide counter. It must be
+// called before the manager creates any session.
+func (manager *Manager) SetIDGenerator(ids IDGenerator) {
+	manager.ids = ids
+}
+
+// sessionMap spreads IDs over the shards with a multiplicative hash, because
+// generated IDs like snowflakes often share their low bits.
+func (manager *Manager) sessionMap(sessionID uint64) *sessionMap {
+	return &manager.sessionMaps[(sessionID*0x9E3779B97F4A7C15)>>(64-sessionMapBits)]
+}
+
 func (manager *Manager) Dispose() {
 	manager.disposeOnce.Do(func() {
 		for i := 0; i < sessionMapNum; i++ {
@@ -41,12 +57,13 @@ func (manager *Manager) Dispose() {
 
 func (manager *Manager) NewSession(codec Codec, sendChanSize int) *Session {
 	session := newSession(manager, codec, sendChanSize)
+	session.start()
 	manager.putSession(session)
 	return session
 }
 
 func (manager *Manager) GetSession(sessionID uint64) *Session {
-	smap := &manager.sessionMaps[sessionID%sessionMapNum]
+	smap := manager.sessionMap(sessionID)
 	smap.RLock()
 	defer smap.RUnlock()
 
@@ -54,13 +71,76 @@ func (manager *Manager) GetSession(sessionID uint64) *Session {
 	return session
 }
 
+func (manager *Manager) Len() int {
+	n := 0
+	for i := 0; i < sessionMapNum; i++ {
+		smap := &manager.sessionMaps[i]
+		smap.RLock()
+		n += len(smap.sessions)
+		smap.RUnlock()
+	}
+	return n
+}
+
+func (manager *Manager) Range(callback func(*Session) bool) {
+	var sessions []*Session
+	for i := 0; i < sessionMapNum; i++ {
+		smap := &manager.sessionMaps[i]
+		smap.RLock()
+		sessions = sessions[:0]
+		for _, session := range smap.sessions {
+			sessions = append(sessions, session)
+		}
+		smap.RUnlock()
+
+		for _, session := range sessions {
+			if !callback(session) {
+				return
+			}
+		}
+	}
+}
+
+func (manager *Manager) FindSession(match func(*Session) bool) *Session {
+	var found *Session
+	manager.Range(func(session *Session) bool {
+		if match(session) {
+			found = session
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func (manager *Manager) Broadcast(msg interface{}, filter func(*Session) bool) map[uint64]error {
+	var sessions []*Session
+	manager.Range(func(session *Session) bool {
+		if filter == nil || filter(session) {
+			sessions = append(sessions, session)
+		}
+		return true
+	})
+
+	var errs map[uint64]error
+	for i, err := range broadcast(sessions, msg) {
+		if err != nil {
+			if errs == nil {
+				errs = make(map[uint64]error)
+			}
+			errs[sessions[i].id] = err
+		}
+	}
+	return errs
+}
+
 func (manager *Manager) putSession(session *Session) {
-	smap := &manager.sessionMaps[session.id%sessionMapNum]
+	smap := manager.sessionMap(session.id)
 
 	smap.Lock()
 	defer smap.Unlock()
 
-	if smap.disposed {
+	if _, exists := smap.sessions[session.id]; exists || smap.disposed {
 		session.Close()
 		return
 	}
@@ -70,12 +150,12 @@ func (manager *Manager) putSession(session *Session) {
 }
 
 func (manager *Manager) delSession(session *Session) {
-	smap := &manager.sessionMaps[session.id%sessionMapNum]
+	smap := manager.sessionMap(session.id)
 
 	smap.Lock()
 	defer smap.Unlock()
 
-	if _, ok := smap.sessions[session.id]; ok {
+	if smap.sessions[session.id] == session {
 		delete(smap.sessions, session.id)
 		manager.disposeWait.Done()
 	}
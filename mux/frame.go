@@ -0,0 +1,43 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	frameOpen   = 1
+	frameData   = 2
+	frameWindow = 3
+	frameClose  = 4
+	frameRefuse = 5
+)
+
+const (
+	headerSize   = 9
+	maxFrameSize = 32 * 1024
+	windowSize   = 256 * 1024
+)
+
+// frame header: [stream id 4][type 1][length or window credit 4]
+type header struct {
+	id     uint32
+	kind   byte
+	length uint32
+}
+
+func (h *header) encode(b []byte) {
+	binary.BigEndian.PutUint32(b[0:], h.id)
+	b[4] = h.kind
+	binary.BigEndian.PutUint32(b[5:], h.length)
+}
+
+func (h *header) readFrom(r io.Reader, b []byte) error {
+	if _, err := io.ReadFull(r, b[:headerSize]); err != nil {
+		return err
+	}
+	h.id = binary.BigEndian.Uint32(b[0:])
+	h.kind = b[4]
+	h.length = binary.BigEndian.Uint32(b[5:])
+	return nil
+}
@@ -0,0 +1,281 @@
+package mux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/funny/link"
+)
+
+var ErrProtocol = errors.New("Mux Protocol Error")
+var ErrStreamRefused = errors.New("Mux Stream Refused")
+
+const acceptBacklog = 256
+
+// Mux carries many Streams over one connection. Every Stream has its own ID,
+// flow control window and close, a slow reader only stalls its own Stream.
+// Mux implements net.Listener, the Streams opened by the peer are returned
+// by Accept, so it can be used with link.NewServer directly.
+type Mux struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex sync.Mutex
+	header     [headerSize]byte
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	acceptChan chan *Stream
+	refused    []uint32
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+// Client creates the Mux for the side which dialed conn, Server for the side
+// which accepted it. The two sides pick stream IDs from different spaces so
+// both may open Streams.
+func Client(conn net.Conn) *Mux {
+	return newMux(conn, 1)
+}
+
+func Server(conn net.Conn) *Mux {
+	return newMux(conn, 2)
+}
+
+func newMux(conn net.Conn, firstID uint32) *Mux {
+	m := &Mux{
+		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		streams:    make(map[uint32]*Stream),
+		nextID:     firstID,
+		acceptChan: make(chan *Stream, acceptBacklog),
+		closeChan:  make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// Open opens a Stream to the peer. When the accept backlog of the peer is
+// full the Stream is refused, its Read and Write return ErrStreamRefused.
+func (m *Mux) Open() (*Stream, error) {
+	m.mutex.Lock()
+	select {
+	case <-m.closeChan:
+		m.mutex.Unlock()
+		return nil, m.err
+	default:
+	}
+	stream := newStream(m, m.nextID)
+	m.streams[stream.id] = stream
+	m.nextID += 2
+	m.mutex.Unlock()
+
+	if err := m.writeFrame(stream.id, frameOpen, 0, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// OpenSession opens a Stream and wraps it in a Session like link.Dial.
+func (m *Mux) OpenSession(protocol link.Protocol, sendChanSize int) (*link.Session, error) {
+	stream, err := m.Open()
+	if err != nil {
+		return nil, err
+	}
+	codec, err := protocol.NewCodec(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return link.NewSession(codec, sendChanSize), nil
+}
+
+func (m *Mux) Accept() (net.Conn, error) {
+	select {
+	case stream := <-m.acceptChan:
+		return stream, nil
+	case <-m.closeChan:
+		return nil, m.err
+	}
+}
+
+func (m *Mux) Addr() net.Addr {
+	return m.conn.LocalAddr()
+}
+
+func (m *Mux) NumStreams() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.streams)
+}
+
+// CloseChan is closed when the underlying connection is gone.
+func (m *Mux) CloseChan() <-chan struct{} {
+	return m.closeChan
+}
+
+func (m *Mux) Err() error {
+	select {
+	case <-m.closeChan:
+		return m.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the underlying connection and all the Streams.
+func (m *Mux) Close() error {
+	return m.close(net.ErrClosed)
+}
+
+func (m *Mux) close(reason error) error {
+	err := net.ErrClosed
+	m.closeOnce.Do(func() {
+		m.mutex.Lock()
+		m.err = reason
+		for _, stream := range m.streams {
+			stream.reset(reason)
+		}
+		m.streams = nil
+		close(m.closeChan)
+		m.mutex.Unlock()
+
+		err = m.conn.Close()
+	})
+	return err
+}
+
+func (m *Mux) readLoop() {
+	var h header
+	var b [headerSize]byte
+	for {
+		if err := h.readFrom(m.reader, b[:]); err != nil {
+			m.close(err)
+			return
+		}
+		if err := m.dispatch(&h); err != nil {
+			m.close(err)
+			return
+		}
+	}
+}
+
+func (m *Mux) dispatch(h *header) error {
+	switch h.kind {
+	case frameOpen:
+		m.mutex.Lock()
+		if m.streams == nil {
+			m.mutex.Unlock()
+			return m.err
+		}
+		_, exists := m.streams[h.id]
+		if exists || h.id%2 == m.nextID%2 {
+			m.mutex.Unlock()
+			return ErrProtocol
+		}
+		stream := newStream(m, h.id)
+		select {
+		case m.acceptChan <- stream:
+			m.streams[h.id] = stream
+		default:
+			if err := m.refuse(h.id); err != nil {
+				m.mutex.Unlock()
+				return err
+			}
+		}
+		m.mutex.Unlock()
+	case frameData:
+		if h.length > maxFrameSize {
+			return ErrProtocol
+		}
+		data := make([]byte, h.length)
+		if _, err := io.ReadFull(m.reader, data); err != nil {
+			return err
+		}
+		if stream := m.stream(h.id); stream != nil {
+			return stream.push(data)
+		}
+	case frameWindow:
+		if stream := m.stream(h.id); stream != nil {
+			stream.grant(int(h.length))
+		}
+	case frameClose:
+		if stream := m.stream(h.id); stream != nil {
+			stream.remoteClose()
+		}
+	case frameRefuse:
+		if stream := m.stream(h.id); stream != nil {
+			m.remove(stream)
+			stream.reset(ErrStreamRefused)
+		}
+	default:
+		return ErrProtocol
+	}
+	return nil
+}
+
+// refuse queues the refusal of a Stream when the accept backlog is full. The
+// read loop must not block on writing, so the frames are written by another
+// goroutine, a peer which keeps opening Streams without reading the
+// refusals is cut off.
+func (m *Mux) refuse(id uint32) error {
+	if len(m.refused) >= acceptBacklog {
+		return ErrProtocol
+	}
+	m.refused = append(m.refused, id)
+	if len(m.refused) == 1 {
+		go m.refuseLoop()
+	}
+	return nil
+}
+
+func (m *Mux) refuseLoop() {
+	m.mutex.Lock()
+	for len(m.refused) > 0 {
+		id := m.refused[0]
+		m.mutex.Unlock()
+		if m.writeFrame(id, frameRefuse, 0, nil) != nil {
+			return
+		}
+		m.mutex.Lock()
+		m.refused = m.refused[1:]
+	}
+	m.mutex.Unlock()
+}
+
+func (m *Mux) stream(id uint32) *Stream {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.streams[id]
+}
+
+func (m *Mux) remove(stream *Stream) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.streams[stream.id] == stream {
+		delete(m.streams, stream.id)
+	}
+}
+
+func (m *Mux) writeFrame(id uint32, kind byte, length int, data []byte) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+
+	h := header{id, kind, uint32(length)}
+	h.encode(m.header[:])
+	buffers := net.Buffers{m.header[:]}
+	if len(data) > 0 {
+		buffers = append(buffers, data)
+	}
+	if _, err := buffers.WriteTo(m.conn); err != nil {
+		go m.close(err)
+		return err
+	}
+	return nil
+}
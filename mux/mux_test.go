@@ -0,0 +1,154 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/funny/utest"
+)
+
+type TestMsg struct {
+	N int
+}
+
+func muxPair(t *testing.T) (*Mux, *Mux) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	utest.IsNilNow(t, err)
+	accepted, err := listener.Accept()
+	utest.IsNilNow(t, err)
+
+	return Client(conn), Server(accepted)
+}
+
+func Test_MuxSessions(t *testing.T) {
+	protocol := codec.Json()
+	protocol.Register(TestMsg{})
+
+	client, server := muxPair(t)
+	defer client.Close()
+
+	srv := link.NewServer(server, protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	go srv.Serve()
+	defer srv.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := client.OpenSession(protocol, 0)
+			utest.IsNilNow(t, err)
+			defer session.Close()
+			for j := 0; j < 100; j++ {
+				utest.IsNilNow(t, session.Send(&TestMsg{j}))
+				msg, err := session.Receive()
+				utest.IsNilNow(t, err)
+				utest.EqualNow(t, msg.(*TestMsg).N, j)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_MuxFlowControl(t *testing.T) {
+	client, server := muxPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	slow, err := client.Open()
+	utest.IsNilNow(t, err)
+	fast, err := client.Open()
+	utest.IsNilNow(t, err)
+
+	slowPeer, err := server.Accept()
+	utest.IsNilNow(t, err)
+	fastPeer, err := server.Accept()
+	utest.IsNilNow(t, err)
+
+	// Nobody reads slow, the write stops at the window.
+	slow.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := slow.Write(make([]byte, windowSize*2))
+	utest.Assert(t, err == ErrDeadline)
+	utest.EqualNow(t, n, windowSize)
+
+	data := make([]byte, windowSize*4)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go fast.Write(data)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(fastPeer, buf)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(buf), string(data))
+
+	// The buffered data is readable after Close, then io.EOF.
+	slow.Close()
+	_, err = io.ReadFull(slowPeer, make([]byte, windowSize))
+	utest.IsNilNow(t, err)
+	_, err = slowPeer.Read(buf)
+	utest.Assert(t, err == io.EOF)
+
+	_, err = slowPeer.Write(buf)
+	utest.Assert(t, err == net.ErrClosed)
+}
+
+func Test_MuxClose(t *testing.T) {
+	client, server := muxPair(t)
+	defer server.Close()
+
+	stream, err := client.Open()
+	utest.IsNilNow(t, err)
+	peer, err := server.Accept()
+	utest.IsNilNow(t, err)
+
+	client.Close()
+	_, err = peer.Read(make([]byte, 1))
+	utest.NotNilNow(t, err)
+	_, err = stream.Write([]byte("x"))
+	utest.NotNilNow(t, err)
+
+	_, err = server.Accept()
+	utest.NotNilNow(t, err)
+}
+
+func Test_MuxRefuse(t *testing.T) {
+	client, server := muxPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	// Nobody accepts, the stream after the backlog is refused.
+	for i := 0; i < acceptBacklog; i++ {
+		_, err := client.Open()
+		utest.IsNilNow(t, err)
+	}
+	stream, err := client.Open()
+	utest.IsNilNow(t, err)
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	utest.Assert(t, err == ErrStreamRefused)
+	_, err = stream.Write([]byte("x"))
+	utest.Assert(t, err == ErrStreamRefused)
+	utest.EqualNow(t, client.NumStreams(), acceptBacklog)
+
+	_, err = server.Accept()
+	utest.IsNilNow(t, err)
+}
@@ -0,0 +1,269 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "Mux Deadline Exceeded" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+var ErrDeadline net.Error = timeoutError{}
+
+// Stream is one logical connection of a Mux. The peer may send at most
+// windowSize bytes ahead of the reader, credit is given back as the data is
+// read. Close closes both directions, the data already sent is still read
+// by the peer before io.EOF.
+type Stream struct {
+	mux *Mux
+	id  uint32
+
+	writeMutex sync.Mutex
+
+	mutex        sync.Mutex
+	readBuf      [][]byte
+	buffered     int
+	consumed     int
+	sendWindow   int
+	localClosed  bool
+	remoteClosed bool
+	err          error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	return &Stream{
+		mux:        m,
+		id:         id,
+		sendWindow: windowSize,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) push(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.localClosed || s.remoteClosed {
+		return nil
+	}
+	if s.buffered+len(data) > windowSize {
+		return ErrProtocol
+	}
+	if len(data) > 0 {
+		s.readBuf = append(s.readBuf, data)
+		s.buffered += len(data)
+		notify(s.readEvent)
+	}
+	return nil
+}
+
+func (s *Stream) grant(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sendWindow += n
+	notify(s.writeEvent)
+}
+
+func (s *Stream) remoteClose() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remoteClosed = true
+	notify(s.readEvent)
+	notify(s.writeEvent)
+}
+
+func (s *Stream) reset(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	notify(s.readEvent)
+	notify(s.writeEvent)
+}
+
+// wait releases the lock until event fires or the deadline is exceeded.
+func (s *Stream) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrDeadline
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	s.mutex.Unlock()
+	defer s.mutex.Lock()
+
+	select {
+	case <-event:
+		return nil
+	case <-timeout:
+		return ErrDeadline
+	case <-s.mux.closeChan:
+		return nil
+	}
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	s.mutex.Lock()
+	for len(s.readBuf) == 0 {
+		switch {
+		case s.localClosed:
+			s.mutex.Unlock()
+			return 0, net.ErrClosed
+		case s.remoteClosed:
+			s.mutex.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			err := s.err
+			s.mutex.Unlock()
+			return 0, err
+		}
+		if err := s.wait(s.readEvent, s.readDeadline); err != nil {
+			s.mutex.Unlock()
+			return 0, err
+		}
+	}
+
+	n := copy(b, s.readBuf[0])
+	if n == len(s.readBuf[0]) {
+		s.readBuf[0] = nil
+		s.readBuf = s.readBuf[1:]
+	} else {
+		s.readBuf[0] = s.readBuf[0][n:]
+	}
+	s.buffered -= n
+	s.consumed += n
+
+	credit := 0
+	if s.consumed >= windowSize/2 {
+		credit = s.consumed
+		s.consumed = 0
+	}
+	s.mutex.Unlock()
+
+	if credit > 0 {
+		s.mux.writeFrame(s.id, frameWindow, credit, nil)
+	}
+	return n, nil
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		s.mutex.Lock()
+		for s.sendWindow == 0 && !s.localClosed && !s.remoteClosed && s.err == nil {
+			if err := s.wait(s.writeEvent, s.writeDeadline); err != nil {
+				s.mutex.Unlock()
+				return written, err
+			}
+		}
+		switch {
+		case s.localClosed, s.remoteClosed:
+			s.mutex.Unlock()
+			return written, net.ErrClosed
+		case s.err != nil:
+			err := s.err
+			s.mutex.Unlock()
+			return written, err
+		}
+		n := len(b) - written
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		s.sendWindow -= n
+		s.mutex.Unlock()
+
+		if err := s.mux.writeFrame(s.id, frameData, n, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	if s.localClosed {
+		s.mutex.Unlock()
+		return net.ErrClosed
+	}
+	s.localClosed = true
+	s.readBuf = nil
+	err := s.err
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	s.mutex.Unlock()
+
+	s.mux.remove(s)
+	if err == nil {
+		s.mux.writeFrame(s.id, frameClose, 0, nil)
+	}
+	return nil
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.mux.conn.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.mux.conn.RemoteAddr()
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	notify(s.readEvent)
+	notify(s.writeEvent)
+	return nil
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.readDeadline = t
+	notify(s.readEvent)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writeDeadline = t
+	notify(s.writeEvent)
+	return nil
+}
@@ -0,0 +1,193 @@
+package link
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var PoolClosedError = errors.New("Pool Closed")
+
+type PoolStrategy int
+
+const (
+	PoolRoundRobin PoolStrategy = iota
+	// PoolLeastPending picks the session with the fewest queued messages. Sync
+	// sessions (sendChanSize 0) have no queue, so it works as PoolRoundRobin.
+	PoolLeastPending
+)
+
+// Pool keeps up to size sessions to one server. Closed sessions are dropped
+// and dialed again on demand or by the health check.
+type Pool struct {
+	dial     func() (*Session, error)
+	size     int
+	strategy PoolStrategy
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	sessions []*Session
+	dialing  int
+	next     int
+	closed   bool
+
+	closeChan chan struct{}
+}
+
+func NewPool(dial func() (*Session, error), size int, strategy PoolStrategy) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	pool := &Pool{
+		dial:      dial,
+		size:      size,
+		strategy:  strategy,
+		closeChan: make(chan struct{}),
+	}
+	pool.cond = sync.NewCond(&pool.mutex)
+	return pool
+}
+
+func (pool *Pool) Len() int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.prune()
+	return len(pool.sessions)
+}
+
+func (pool *Pool) Get() (*Session, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for {
+		if pool.closed {
+			return nil, PoolClosedError
+		}
+		pool.prune()
+
+		if len(pool.sessions)+pool.dialing < pool.size {
+			session, err := pool.add()
+			if err == nil || len(pool.sessions) == 0 {
+				return session, err
+			}
+		}
+		if len(pool.sessions) > 0 {
+			return pool.pick(), nil
+		}
+		// The pool is full of dials in flight, wait for one of them.
+		pool.cond.Wait()
+	}
+}
+
+func (pool *Pool) Send(msg interface{}) error {
+	session, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	return session.Send(msg)
+}
+
+// add dials a new session without holding the lock.
+func (pool *Pool) add() (*Session, error) {
+	pool.dialing++
+	pool.mutex.Unlock()
+	session, err := pool.dial()
+	pool.mutex.Lock()
+	pool.dialing--
+	defer pool.cond.Broadcast()
+
+	if err != nil {
+		return nil, err
+	}
+	if pool.closed {
+		session.Close()
+		return nil, PoolClosedError
+	}
+	pool.sessions = append(pool.sessions, session)
+	return session, nil
+}
+
+func (pool *Pool) prune() {
+	n := 0
+	for _, session := range pool.sessions {
+		if !session.IsClosed() {
+			pool.sessions[n] = session
+			n++
+		}
+	}
+	for i := n; i < len(pool.sessions); i++ {
+		pool.sessions[i] = nil
+	}
+	pool.sessions = pool.sessions[:n]
+}
+
+func (pool *Pool) pick() *Session {
+	start := pool.next % len(pool.sessions)
+	pool.next = start + 1
+
+	session := pool.sessions[start]
+	if pool.strategy == PoolLeastPending {
+		for i := 1; i < len(pool.sessions); i++ {
+			s := pool.sessions[(start+i)%len(pool.sessions)]
+			if s.Pending() < session.Pending() {
+				session = s
+			}
+		}
+	}
+	return session
+}
+
+// HealthCheck starts a goroutine which runs check on every session at the
+// given interval, closes the failed ones and dials the pool back to full size.
+func (pool *Pool) HealthCheck(interval time.Duration, check func(*Session) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-pool.closeChan:
+				return
+			}
+
+			pool.mutex.Lock()
+			sessions := append([]*Session(nil), pool.sessions...)
+			pool.mutex.Unlock()
+
+			if check != nil {
+				for _, session := range sessions {
+					if check(session) != nil {
+						session.Close()
+					}
+				}
+			}
+
+			pool.mutex.Lock()
+			pool.prune()
+			for !pool.closed && len(pool.sessions)+pool.dialing < pool.size {
+				if _, err := pool.add(); err != nil {
+					break
+				}
+			}
+			pool.mutex.Unlock()
+		}
+	}()
+}
+
+func (pool *Pool) Close() {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return
+	}
+	pool.closed = true
+	sessions := pool.sessions
+	pool.sessions = nil
+	close(pool.closeChan)
+	pool.cond.Broadcast()
+	pool.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+}
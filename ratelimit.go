@@ -0,0 +1,191 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/funny/link/internal/vecio"
+)
+
+var SessionRateLimitedError = errors.New("Session Rate Limited")
+
+// errRateDrop tells Receive and sendLoop to discard the message.
+var errRateDrop = errors.New("Rate Limit Drop")
+
+type RatePolicy int
+
+const (
+	// RateDelay waits until the limit allows the message.
+	RateDelay RatePolicy = iota
+	// RateDrop discards the messages over the limit.
+	RateDrop
+	// RateClose closes the session with SessionRateLimitedError.
+	RateClose
+)
+
+// RateLimit is a token bucket limit on one direction of a session. A zero
+// rate means no limit. The bytes are counted on the connection, so a message
+// larger than the bucket still passes and the following ones pay its debt.
+type RateLimit struct {
+	Messages     float64 // messages per second
+	Bytes        float64 // bytes per second
+	MessageBurst int     // bucket size, 0 means one second of Messages
+	ByteBurst    int     // bucket size, 0 means one second of Bytes
+	Policy       RatePolicy
+}
+
+func (limit RateLimit) enabled() bool {
+	return limit.Messages > 0 || limit.Bytes > 0
+}
+
+type rateBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateBucket(rate float64, burst int, now time.Time) rateBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return rateBucket{rate, b, b, now}
+}
+
+func (b *rateBucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// delay returns how long to wait until the bucket has min tokens.
+func (b *rateBucket) delay(min float64) time.Duration {
+	if b.rate <= 0 || b.tokens >= min {
+		return 0
+	}
+	return time.Duration((min - b.tokens) / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits one direction of a session, it is only used by one
+// goroutine at a time, the receiver or the sender.
+type rateLimiter struct {
+	policy   RatePolicy
+	messages rateBucket
+	bytes    rateBucket
+	count    func() int64
+	counted  int64
+}
+
+func newRateLimiter(limit RateLimit, count func() int64) *rateLimiter {
+	now := time.Now()
+	return &rateLimiter{
+		policy:   limit.Policy,
+		messages: newRateBucket(limit.Messages, limit.MessageBurst, now),
+		bytes:    newRateBucket(limit.Bytes, limit.ByteBurst, now),
+		count:    count,
+	}
+}
+
+// admit takes a message token, it returns errRateDrop or
+// SessionRateLimitedError by the policy when the limit is exceeded.
+// beforeWait may be nil, it runs once before RateDelay waits.
+func (l *rateLimiter) admit(closeChan <-chan int, beforeWait func() error) error {
+	for {
+		now := time.Now()
+		l.messages.refill(now)
+		l.bytes.refill(now)
+
+		delay := l.messages.delay(1)
+		if d := l.bytes.delay(0); d > delay {
+			delay = d
+		}
+		if delay == 0 {
+			if l.messages.rate > 0 {
+				l.messages.tokens--
+			}
+			return nil
+		}
+
+		switch l.policy {
+		case RateDrop:
+			return errRateDrop
+		case RateClose:
+			return SessionRateLimitedError
+		}
+		if beforeWait != nil {
+			beforeWait()
+			beforeWait = nil
+			l.charge()
+			continue
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-closeChan:
+			timer.Stop()
+			return SessionClosedError
+		}
+	}
+}
+
+// charge takes the bytes moved on the connection since the last charge.
+func (l *rateLimiter) charge() {
+	if l.count == nil || l.bytes.rate <= 0 {
+		return
+	}
+	n := l.count()
+	l.bytes.tokens -= float64(n - l.counted)
+	l.counted = n
+}
+
+// countingConn counts the bytes read and written for the byte rate limits.
+type countingConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// WriteBuffers keeps the vectored writes of the codecs on the inner conn.
+func (c *countingConn) WriteBuffers(buffers net.Buffers) (int64, error) {
+	n, err := vecio.Write(c.Conn, buffers)
+	atomic.AddInt64(&c.written, n)
+	return n, err
+}
+
+func (c *countingConn) readCount() int64 {
+	return atomic.LoadInt64(&c.read)
+}
+
+func (c *countingConn) writeCount() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// SetRateLimit limits every session of the Server, recv applies to Receive
+// and send to Send. It must be called before Serve.
+func (server *Server) SetRateLimit(recv, send RateLimit) {
+	server.recvLimit = recv
+	server.sendLimit = send
+}
@@ -0,0 +1,114 @@
+package link
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func RateLimitTest(t *testing.T, recv, send RateLimit, handler func(*Session)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	server := NewServer(listener, ProtocolFunc(NewTestCodec), 16, HandlerFunc(handler))
+	server.SetRateLimit(recv, send)
+	go server.Serve()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func Test_RateLimitDrop(t *testing.T) {
+	received := make(chan int)
+	addr := RateLimitTest(t, RateLimit{Messages: 10, MessageBurst: 5, Policy: RateDrop}, RateLimit{}, func(session *Session) {
+		n := 0
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if string(msg.([]byte)) == "end" {
+				received <- n
+				return
+			}
+			n++
+		}
+	})
+
+	session, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	for i := 0; i < 50; i++ {
+		utest.IsNilNow(t, session.Send([]byte("flood")))
+	}
+	time.Sleep(200 * time.Millisecond)
+	utest.IsNilNow(t, session.Send([]byte("end")))
+
+	n := <-received
+	utest.Assert(t, n >= 5 && n < 10)
+}
+
+func Test_RateLimitClose(t *testing.T) {
+	addr := RateLimitTest(t, RateLimit{Messages: 1, Policy: RateClose}, RateLimit{}, func(session *Session) {
+		for {
+			if _, err := session.Receive(); err != nil {
+				return
+			}
+		}
+	})
+
+	session, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	utest.IsNilNow(t, session.Send([]byte("1")))
+	utest.IsNilNow(t, session.Send([]byte("2")))
+	_, err = session.Receive()
+	utest.NotNilNow(t, err)
+}
+
+func Test_RateLimitDelay(t *testing.T) {
+	addr := RateLimitTest(t, RateLimit{}, RateLimit{Bytes: 10 * 1024, ByteBurst: 1024, Policy: RateDelay}, func(session *Session) {
+		if _, err := session.Receive(); err != nil {
+			return
+		}
+		for i := 0; i < 5; i++ {
+			session.Send(make([]byte, 1022))
+		}
+		session.Receive()
+	})
+
+	session, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	defer session.Close()
+	start := time.Now()
+	utest.IsNilNow(t, session.Send([]byte("go")))
+	for i := 0; i < 5; i++ {
+		_, err := session.Receive()
+		utest.IsNilNow(t, err)
+	}
+	utest.Assert(t, time.Since(start) > 250*time.Millisecond)
+}
+
+type writeCounterConn struct {
+	net.Conn
+	writes int
+	data   []byte
+}
+
+func (c *writeCounterConn) Write(b []byte) (int, error) {
+	c.writes++
+	c.data = append(c.data, b...)
+	return len(b), nil
+}
+
+func Test_CountingConnWriteBuffers(t *testing.T) {
+	inner := new(writeCounterConn)
+	conn := &countingConn{Conn: inner}
+
+	n, err := conn.WriteBuffers(net.Buffers{[]byte("head"), []byte("body")})
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, n, int64(8))
+	utest.EqualNow(t, inner.writes, 1)
+	utest.EqualNow(t, string(inner.data), "headbody")
+	utest.EqualNow(t, conn.writeCount(), int64(8))
+}
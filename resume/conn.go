@@ -0,0 +1,504 @@
+package resume
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrRejected = errors.New("Resume Rejected")
+var ErrGraceTimeout = errors.New("Resume Grace Timeout")
+var ErrBufferOverflow = errors.New("Resume Buffer Overflow")
+
+const handshakeTimeout = 10 * time.Second
+
+const (
+	typeNew    = 0
+	typeResume = 1
+	typeClose  = 2
+
+	statusOK       = 0
+	statusRejected = 1
+)
+
+type token [16]byte
+
+// handshake is sent by both sides when a connection is established:
+// [type or status 1][token 16][read count 8]. A typeClose handshake is sent
+// on a new connection by a closing client and carries its write count.
+type handshake struct {
+	kind  byte
+	token token
+	read  uint64
+}
+
+func (h *handshake) writeTo(w io.Writer) error {
+	var b [25]byte
+	b[0] = h.kind
+	copy(b[1:17], h.token[:])
+	binary.BigEndian.PutUint64(b[17:], h.read)
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (h *handshake) readFrom(r io.Reader) error {
+	var b [25]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	h.kind = b[0]
+	copy(h.token[:], b[1:17])
+	h.read = binary.BigEndian.Uint64(b[17:])
+	return nil
+}
+
+// Conn is a net.Conn that survives reconnects of the underlying connection.
+// The last written bytes are kept in a fixed size buffer and the bytes the
+// peer has not received are replayed after a reconnect.
+type Conn struct {
+	token    token
+	grace    time.Duration
+	dial     func() (net.Conn, error)
+	listener *Listener
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	base     net.Conn
+	broken   bool
+	closed   bool
+	closeErr error
+	timer    *time.Timer
+
+	// finishing is set when the client has closed, the Conn is closed with
+	// io.EOF once finishCount bytes are read or the connection breaks.
+	finishing   bool
+	finishCount uint64
+
+	// brokenAt is the write count when the connection broke, the writes
+	// during the outage are kept in the buffer until it is full.
+	brokenAt uint64
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readMutex sync.Mutex
+	readCount uint64
+
+	writeMutex sync.Mutex
+	writeCount uint64
+	buffer     []byte
+}
+
+func newConn(base net.Conn, bufferSize int, grace time.Duration) *Conn {
+	c := &Conn{
+		base:   base,
+		grace:  grace,
+		buffer: make([]byte, bufferSize),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+func Dial(network, address string, bufferSize int, grace time.Duration) (*Conn, error) {
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	return DialFunc(func() (net.Conn, error) {
+		return dialer.Dial(network, address)
+	}, bufferSize, grace)
+}
+
+// DialFunc creates a Conn which reconnects with dial. dial should give up
+// in a bounded time, Close uses it to tell the server.
+func DialFunc(dial func() (net.Conn, error), bufferSize int, grace time.Duration) (*Conn, error) {
+	base, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := clientHandshake(base, &handshake{kind: typeNew})
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	c := newConn(base, bufferSize, grace)
+	c.token = reply.token
+	c.dial = dial
+	return c, nil
+}
+
+func clientHandshake(base net.Conn, hello *handshake) (*handshake, error) {
+	base.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := hello.writeTo(base); err != nil {
+		return nil, err
+	}
+	var reply handshake
+	if err := reply.readFrom(base); err != nil {
+		return nil, err
+	}
+	if reply.kind != statusOK {
+		return nil, ErrRejected
+	}
+	base.SetDeadline(time.Time{})
+	return &reply, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		if err := c.wait(); err != nil {
+			return 0, err
+		}
+
+		c.readMutex.Lock()
+		base := c.base
+		n, err := base.Read(b)
+		readCount := atomic.AddUint64(&c.readCount, uint64(n))
+		c.readMutex.Unlock()
+
+		if n > 0 || err == nil {
+			c.mutex.Lock()
+			finished := c.finishing && readCount >= c.finishCount
+			c.mutex.Unlock()
+			if finished {
+				c.closeWith(io.EOF)
+			}
+			return n, nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return 0, err
+		}
+		c.setBroken(base)
+	}
+}
+
+// Write keeps b in the buffer and writes it to the connection. While the
+// connection is broken b is only kept, Write blocks when the bytes written
+// since the break would not fit in the buffer.
+func (c *Conn) Write(b []byte) (int, error) {
+	for {
+		// writeMutex is held by resume and accept until the Conn is bound
+		// again, so the broken state does not end while it is held.
+		c.writeMutex.Lock()
+		c.mutex.Lock()
+		if c.closed {
+			err := c.closeErr
+			c.mutex.Unlock()
+			c.writeMutex.Unlock()
+			return 0, err
+		}
+		if c.broken {
+			room := c.writeCount-c.brokenAt+uint64(len(b)) <= uint64(len(c.buffer))
+			c.mutex.Unlock()
+			if room {
+				c.keep(b)
+				c.writeMutex.Unlock()
+				return len(b), nil
+			}
+			c.writeMutex.Unlock()
+			if err := c.wait(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		base := c.base
+		c.mutex.Unlock()
+
+		c.keep(b)
+		_, err := base.Write(b)
+		c.writeMutex.Unlock()
+
+		if err != nil {
+			// The bytes are kept in the buffer and replayed after the reconnect.
+			c.setBroken(base)
+		}
+		return len(b), nil
+	}
+}
+
+func (c *Conn) keep(b []byte) {
+	size := uint64(len(c.buffer))
+	if size > 0 {
+		if uint64(len(b)) > size {
+			skip := uint64(len(b)) - size
+			b = b[skip:]
+			atomic.AddUint64(&c.writeCount, skip)
+		}
+		for len(b) > 0 {
+			n := copy(c.buffer[c.writeCount%size:], b)
+			b = b[n:]
+			atomic.AddUint64(&c.writeCount, uint64(n))
+		}
+		return
+	}
+	atomic.AddUint64(&c.writeCount, uint64(len(b)))
+}
+
+// replay writes the bytes after the peer's read count, writeMutex must be held.
+func (c *Conn) replay(w io.Writer, peerRead uint64) error {
+	size := uint64(len(c.buffer))
+	if peerRead > c.writeCount || c.writeCount-peerRead > size {
+		return ErrBufferOverflow
+	}
+	for peerRead < c.writeCount {
+		start := peerRead % size
+		end := start + c.writeCount - peerRead
+		if end > size {
+			end = size
+		}
+		if _, err := w.Write(c.buffer[start:end]); err != nil {
+			return err
+		}
+		peerRead += end - start
+	}
+	return nil
+}
+
+func (c *Conn) wait() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.broken && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return c.closeErr
+	}
+	return nil
+}
+
+func (c *Conn) setBroken(base net.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.base != base || c.broken || c.closed {
+		return
+	}
+	c.broken = true
+	c.brokenAt = atomic.LoadUint64(&c.writeCount)
+	base.Close()
+
+	if c.finishing {
+		go c.closeWith(io.EOF)
+		return
+	}
+
+	if c.dial != nil {
+		go c.reconnect()
+		return
+	}
+	c.timer = time.AfterFunc(c.grace, func() {
+		c.mutex.Lock()
+		expired := c.base == base && c.broken
+		c.mutex.Unlock()
+		if expired {
+			c.closeWith(ErrGraceTimeout)
+		}
+	})
+}
+
+func (c *Conn) reconnect() {
+	deadline := time.Now().Add(c.grace)
+	delay := 50 * time.Millisecond
+	for {
+		base, err := c.dial()
+		if err == nil {
+			err = c.resume(base)
+			if err == nil {
+				return
+			}
+			base.Close()
+			if err == ErrRejected || err == ErrBufferOverflow {
+				c.closeWith(err)
+				return
+			}
+		}
+		if c.isClosed() {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.closeWith(ErrGraceTimeout)
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
+
+// resume runs the client side of a reconnect.
+func (c *Conn) resume(base net.Conn) error {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	reply, err := clientHandshake(base, &handshake{typeResume, c.token, c.readCount})
+	if err != nil {
+		return err
+	}
+	if err := c.replay(base, reply.read); err != nil {
+		return err
+	}
+	return c.rebind(base)
+}
+
+// accept runs the server side of a reconnect.
+func (c *Conn) accept(base net.Conn, peerRead uint64) error {
+	c.mutex.Lock()
+	old := c.base
+	c.mutex.Unlock()
+	c.setBroken(old)
+
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	reply := handshake{statusOK, c.token, c.readCount}
+	if err := reply.writeTo(base); err != nil {
+		return err
+	}
+	if err := c.replay(base, peerRead); err != nil {
+		return err
+	}
+	base.SetDeadline(time.Time{})
+	return c.rebind(base)
+}
+
+func (c *Conn) rebind(base net.Conn) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return c.closeErr
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.base = base
+	c.broken = false
+	base.SetReadDeadline(c.readDeadline)
+	base.SetWriteDeadline(c.writeDeadline)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+// Close closes the Conn. A client with a working connection tells the server
+// on a new connection, so the server side is closed with io.EOF after it
+// reads the written bytes instead of waiting until the grace period ends.
+// During an outage the server is left to its grace period.
+func (c *Conn) Close() error {
+	if c.dial != nil {
+		c.mutex.Lock()
+		healthy := !c.closed && !c.broken
+		c.mutex.Unlock()
+		if healthy {
+			c.sendClose()
+		}
+	}
+	return c.closeWith(net.ErrClosed)
+}
+
+func (c *Conn) sendClose() {
+	base, err := c.dial()
+	if err != nil {
+		return
+	}
+	defer base.Close()
+	clientHandshake(base, &handshake{typeClose, c.token, atomic.LoadUint64(&c.writeCount)})
+}
+
+// finish runs the server side of a client close.
+func (c *Conn) finish(writeCount uint64) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.finishing = true
+	c.finishCount = writeCount
+	finished := c.broken || atomic.LoadUint64(&c.readCount) >= writeCount
+	c.mutex.Unlock()
+
+	if finished {
+		c.closeWith(io.EOF)
+	}
+}
+
+func (c *Conn) closeWith(reason error) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.closeErr = reason
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	base := c.base
+	broken := c.broken
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+
+	if c.listener != nil {
+		c.listener.remove(c)
+	}
+	err := base.Close()
+	if broken {
+		// setBroken has closed base already.
+		return nil
+	}
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.base.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.base.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return c.base.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	return c.base.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	return c.base.SetWriteDeadline(t)
+}
+
+func newToken() (t token) {
+	if _, err := rand.Read(t[:]); err != nil {
+		panic(err)
+	}
+	return
+}
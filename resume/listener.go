@@ -0,0 +1,158 @@
+package resume
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/funny/link"
+)
+
+// Listener accepts connections from Dial. A reconnecting client is bound back
+// to its Conn, only new clients are returned by Accept.
+type Listener struct {
+	base       net.Listener
+	bufferSize int
+	grace      time.Duration
+
+	mutex sync.Mutex
+	conns map[token]*Conn
+
+	acceptChan chan *Conn
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+func Listen(network, address string, bufferSize int, grace time.Duration) (*Listener, error) {
+	base, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(base, bufferSize, grace), nil
+}
+
+func NewListener(base net.Listener, bufferSize int, grace time.Duration) *Listener {
+	l := &Listener{
+		base:       base,
+		bufferSize: bufferSize,
+		grace:      grace,
+		conns:      make(map[token]*Conn),
+		acceptChan: make(chan *Conn),
+		closeChan:  make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := link.Accept(l.base)
+		if err != nil {
+			l.close(err)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *Listener) handshake(base net.Conn) {
+	base.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var hello handshake
+	if err := hello.readFrom(base); err != nil {
+		base.Close()
+		return
+	}
+
+	if hello.kind == typeClose {
+		l.mutex.Lock()
+		c, exists := l.conns[hello.token]
+		l.mutex.Unlock()
+
+		reply := handshake{kind: statusRejected}
+		if exists {
+			c.finish(hello.read)
+			reply = handshake{statusOK, hello.token, 0}
+		}
+		reply.writeTo(base)
+		base.Close()
+		return
+	}
+
+	if hello.kind == typeResume {
+		l.mutex.Lock()
+		c, exists := l.conns[hello.token]
+		l.mutex.Unlock()
+
+		if !exists {
+			reply := handshake{kind: statusRejected}
+			reply.writeTo(base)
+			base.Close()
+			return
+		}
+		if err := c.accept(base, hello.read); err != nil {
+			base.Close()
+			if err == ErrBufferOverflow {
+				c.closeWith(err)
+			}
+		}
+		return
+	}
+
+	c := newConn(base, l.bufferSize, l.grace)
+	c.token = newToken()
+	c.listener = l
+
+	reply := handshake{statusOK, c.token, 0}
+	if err := reply.writeTo(base); err != nil {
+		base.Close()
+		return
+	}
+	base.SetDeadline(time.Time{})
+
+	l.mutex.Lock()
+	l.conns[c.token] = c
+	l.mutex.Unlock()
+
+	select {
+	case l.acceptChan <- c:
+	case <-l.closeChan:
+		c.Close()
+	}
+}
+
+func (l *Listener) remove(c *Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[c.token] == c {
+		delete(l.conns, c.token)
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.acceptChan:
+		return c, nil
+	case <-l.closeChan:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.close(net.ErrClosed)
+}
+
+func (l *Listener) close(reason error) error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		l.err = reason
+		close(l.closeChan)
+		err = l.base.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.base.Addr()
+}
@@ -0,0 +1,249 @@
+package resume
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/funny/utest"
+)
+
+type TestMsg struct {
+	N int
+}
+
+type testDialer struct {
+	sync.Mutex
+	addr  string
+	conns []net.Conn
+	down  int32
+}
+
+func (d *testDialer) dial() (net.Conn, error) {
+	if atomic.LoadInt32(&d.down) == 1 {
+		return nil, errors.New("network down")
+	}
+	conn, err := net.Dial("tcp", d.addr)
+	if err == nil {
+		d.Lock()
+		d.conns = append(d.conns, conn)
+		d.Unlock()
+	}
+	return conn, err
+}
+
+func (d *testDialer) breakConn() {
+	d.Lock()
+	defer d.Unlock()
+	d.conns[len(d.conns)-1].Close()
+}
+
+func Test_Resume(t *testing.T) {
+	protocol := codec.Json()
+	protocol.Register(TestMsg{})
+
+	listener, err := Listen("tcp", "127.0.0.1:0", 64*1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+
+	server := link.NewServer(listener, protocol, 1024, link.HandlerFunc(func(session *link.Session) {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	dialer := &testDialer{addr: listener.Addr().String()}
+	conn, err := DialFunc(dialer.dial, 64*1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+
+	codec, err := protocol.NewCodec(conn)
+	utest.IsNilNow(t, err)
+	session := link.NewSession(codec, 0)
+
+	for i := 0; i < 1000; i++ {
+		if i%100 == 50 {
+			dialer.breakConn()
+		}
+		utest.IsNilNow(t, session.Send(&TestMsg{i}))
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, msg.(*TestMsg).N, i)
+	}
+
+	dialer.Lock()
+	utest.EqualNow(t, len(dialer.conns), 11)
+	dialer.Unlock()
+	utest.EqualNow(t, server.Manager().Len(), 1)
+
+	session.Close()
+}
+
+func Test_ResumeRejected(t *testing.T) {
+	listener, err := Listen("tcp", "127.0.0.1:0", 1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := Dial("tcp", listener.Addr().String(), 1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+
+	_, err = conn.Read(make([]byte, 1))
+	utest.EqualNow(t, err, ErrRejected)
+}
+
+func Test_ResumeClose(t *testing.T) {
+	listener, err := Listen("tcp", "127.0.0.1:0", 1024, 10*time.Second)
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	conn, err := Dial("tcp", listener.Addr().String(), 1024, 10*time.Second)
+	utest.IsNilNow(t, err)
+
+	serverConn, err := listener.Accept()
+	utest.IsNilNow(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	utest.IsNilNow(t, err)
+	utest.IsNilNow(t, conn.Close())
+
+	start := time.Now()
+	data, err := ioutil.ReadAll(serverConn)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(data), "hello")
+	utest.Assert(t, time.Since(start) < time.Second)
+
+	listener.mutex.Lock()
+	utest.EqualNow(t, len(listener.conns), 0)
+	listener.mutex.Unlock()
+}
+
+func Test_ResumeCloseSession(t *testing.T) {
+	protocol := codec.Json()
+	protocol.Register(TestMsg{})
+
+	listener, err := Listen("tcp", "127.0.0.1:0", 1024, 10*time.Second)
+	utest.IsNilNow(t, err)
+
+	closed := make(chan time.Time, 1)
+	server := link.NewServer(listener, protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		for {
+			if _, err := session.Receive(); err != nil {
+				closed <- time.Now()
+				return
+			}
+		}
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	conn, err := Dial("tcp", listener.Addr().String(), 1024, 10*time.Second)
+	utest.IsNilNow(t, err)
+	codec, err := protocol.NewCodec(conn)
+	utest.IsNilNow(t, err)
+	session := link.NewSession(codec, 0)
+	utest.IsNilNow(t, session.Send(&TestMsg{1}))
+
+	start := time.Now()
+	session.Close()
+	select {
+	case at := <-closed:
+		utest.Assert(t, at.Sub(start) < time.Second)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session not closed")
+	}
+}
+
+func Test_ResumeWriteDuringOutage(t *testing.T) {
+	protocol := codec.Json()
+	protocol.Register(TestMsg{})
+
+	listener, err := Listen("tcp", "127.0.0.1:0", 64*1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+
+	server := link.NewServer(listener, protocol, 1024, link.HandlerFunc(func(session *link.Session) {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	dialer := &testDialer{addr: listener.Addr().String()}
+	conn, err := DialFunc(dialer.dial, 64*1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+	codec, err := protocol.NewCodec(conn)
+	utest.IsNilNow(t, err)
+	session := link.NewSession(codec, 8)
+	defer session.Close()
+
+	utest.IsNilNow(t, session.Send(&TestMsg{-1}))
+	msg, err := session.Receive()
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, msg.(*TestMsg).N, -1)
+
+	// The async session keeps sending while the client can not reconnect.
+	atomic.StoreInt32(&dialer.down, 1)
+	dialer.breakConn()
+	for i := 0; i < 100; i++ {
+		utest.IsNilNow(t, session.Send(&TestMsg{i}))
+		time.Sleep(2 * time.Millisecond)
+	}
+	atomic.StoreInt32(&dialer.down, 0)
+
+	for i := 0; i < 100; i++ {
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, msg.(*TestMsg).N, i)
+	}
+	dialer.Lock()
+	utest.Assert(t, len(dialer.conns) >= 2)
+	dialer.Unlock()
+}
+
+func Test_ResumeCloseDuringOutage(t *testing.T) {
+	listener, err := Listen("tcp", "127.0.0.1:0", 1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	dialer := &testDialer{addr: listener.Addr().String()}
+	conn, err := DialFunc(dialer.dial, 1024, 5*time.Second)
+	utest.IsNilNow(t, err)
+	_, err = listener.Accept()
+	utest.IsNilNow(t, err)
+
+	atomic.StoreInt32(&dialer.down, 1)
+	dialer.breakConn()
+	_, err = conn.Write([]byte("hello"))
+	utest.IsNilNow(t, err)
+	_, err = conn.Write([]byte("hello"))
+	utest.IsNilNow(t, err)
+
+	start := time.Now()
+	utest.IsNilNow(t, conn.Close())
+	utest.Assert(t, time.Since(start) < 100*time.Millisecond)
+}
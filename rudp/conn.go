@@ -0,0 +1,486 @@
+package rudp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrTimeout = &timeoutError{"RUDP Connection Timeout"}
+var ErrDeadline = &timeoutError{"RUDP Deadline Exceeded"}
+var ErrReset = errors.New("RUDP Connection Reset")
+
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Conn is a reliable ordered stream over UDP. Data is cut into segments,
+// every segment is acknowledged and resent on timeout or when later segments
+// are acknowledged three times, and the sender never has more segments in
+// flight than the receiver's window.
+type Conn struct {
+	conv    uint32
+	local   net.Addr
+	remote  net.Addr
+	output  func([]byte) error
+	onClose func()
+
+	mutex    sync.Mutex
+	sndNxt   uint32
+	sndUna   uint32
+	sndQueue []*segment
+	sndBuf   []*segment
+	rmtWnd   uint16
+	rcvNxt   uint32
+	rcvBuf   map[uint32]*segment
+	rcvQueue [][]byte
+	readBuf  []byte
+	eof      bool
+	finSent  bool
+	finRecv  bool
+
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	lastRecv time.Time
+	lastSend time.Time
+
+	established bool
+	closed      bool
+	closeErr    error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+	kick       chan struct{}
+	closeChan  chan struct{}
+	packet     [mtu]byte
+}
+
+// newConn starts a Conn, onClose may be nil and runs once when it is closed.
+func newConn(conv uint32, local, remote net.Addr, output func([]byte) error, onClose func()) *Conn {
+	c := &Conn{
+		conv:       conv,
+		local:      local,
+		remote:     remote,
+		output:     output,
+		onClose:    onClose,
+		rmtWnd:     windowSize,
+		rcvBuf:     make(map[uint32]*segment),
+		rto:        initRTO,
+		lastRecv:   time.Now(),
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+		kick:       make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) send(cmd byte, sn uint32, data []byte) {
+	h := header{
+		conv: c.conv,
+		cmd:  cmd,
+		sn:   sn,
+		una:  c.rcvNxt,
+		wnd:  c.window(),
+	}
+	h.encode(c.packet[:], len(data))
+	n := copy(c.packet[headerSize:], data)
+	c.lastSend = time.Now()
+	c.output(c.packet[:headerSize+n])
+}
+
+func (c *Conn) window() uint16 {
+	if n := windowSize - len(c.rcvQueue); n > 0 {
+		return uint16(n)
+	}
+	return 0
+}
+
+func (c *Conn) input(h header, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	if h.cmd == cmdRst {
+		c.closeLocked(ErrReset)
+		return
+	}
+	c.lastRecv = time.Now()
+	c.established = true
+	c.rmtWnd = h.wnd
+	c.acknowledge(h.una)
+
+	switch h.cmd {
+	case cmdAck:
+		c.ack(h.sn)
+	case cmdPush, cmdFin:
+		if diff(h.sn, c.rcvNxt+windowSize) < 0 {
+			if diff(h.sn, c.rcvNxt) >= 0 {
+				if _, exists := c.rcvBuf[h.sn]; !exists {
+					c.rcvBuf[h.sn] = &segment{
+						cmd:  h.cmd,
+						sn:   h.sn,
+						data: append([]byte(nil), data...),
+					}
+				}
+				c.deliver()
+			}
+			c.send(cmdAck, h.sn, nil)
+		}
+	case cmdPing:
+		c.send(cmdPong, 0, nil)
+	}
+	c.flush()
+	notify(c.writeEvent)
+}
+
+func (c *Conn) deliver() {
+	for {
+		seg, exists := c.rcvBuf[c.rcvNxt]
+		if !exists {
+			return
+		}
+		delete(c.rcvBuf, c.rcvNxt)
+		c.rcvNxt++
+		if seg.cmd == cmdFin {
+			c.finRecv = true
+			c.rcvQueue = append(c.rcvQueue, nil)
+		} else {
+			c.rcvQueue = append(c.rcvQueue, seg.data)
+		}
+		notify(c.readEvent)
+	}
+}
+
+// acknowledge drops the segments before una from the send buffer.
+func (c *Conn) acknowledge(una uint32) {
+	n := 0
+	for _, seg := range c.sndBuf {
+		if diff(seg.sn, una) >= 0 {
+			c.sndBuf[n] = seg
+			n++
+		}
+	}
+	c.sndBuf = c.sndBuf[:n]
+	if diff(una, c.sndUna) > 0 {
+		c.sndUna = una
+	}
+}
+
+func (c *Conn) ack(sn uint32) {
+	now := time.Now()
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				c.updateRTO(now.Sub(seg.sentAt))
+			}
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			break
+		}
+		if diff(seg.sn, sn) < 0 {
+			seg.fastack++
+		}
+	}
+}
+
+func (c *Conn) updateRTO(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	} else if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// flush sends queued segments allowed by the window and resends the lost ones.
+func (c *Conn) flush() {
+	now := time.Now()
+
+	window := int(c.rmtWnd)
+	if window > windowSize {
+		window = windowSize
+	}
+	for len(c.sndQueue) > 0 && len(c.sndBuf) < window {
+		seg := c.sndQueue[0]
+		c.sndQueue[0] = nil
+		c.sndQueue = c.sndQueue[1:]
+		seg.sn = c.sndNxt
+		c.sndNxt++
+		seg.rto = c.rto
+		c.sndBuf = append(c.sndBuf, seg)
+		c.transmit(seg, now)
+		notify(c.writeEvent)
+	}
+
+	for _, seg := range c.sndBuf {
+		if seg.xmit == 0 {
+			continue
+		}
+		if !now.Before(seg.resend) {
+			if seg.xmit >= maxXmit {
+				c.closeLocked(ErrTimeout)
+				return
+			}
+			if seg.rto *= 2; seg.rto > maxRTO {
+				seg.rto = maxRTO
+			}
+			c.transmit(seg, now)
+		} else if seg.fastack >= fastResend {
+			c.transmit(seg, now)
+		}
+	}
+}
+
+func (c *Conn) transmit(seg *segment, now time.Time) {
+	seg.xmit++
+	seg.fastack = 0
+	seg.sentAt = now
+	seg.resend = now.Add(seg.rto)
+	c.send(seg.cmd, seg.sn, seg.data)
+}
+
+// loop drives the retransmit timer and the keepalive.
+func (c *Conn) loop() {
+	timer := time.NewTimer(c.rto)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.kick:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-c.closeChan:
+			return
+		}
+
+		c.mutex.Lock()
+		now := time.Now()
+		if now.Sub(c.lastRecv) > idleTimeout {
+			c.closeLocked(ErrTimeout)
+		} else {
+			c.flush()
+			if (c.rmtWnd == 0 && now.Sub(c.lastSend) > probeTimeout) || now.Sub(c.lastSend) > keepalive {
+				c.send(cmdPing, 0, nil)
+			}
+		}
+		next := keepalive
+		if c.rmtWnd == 0 {
+			next = probeTimeout
+		}
+		for _, seg := range c.sndBuf {
+			if d := seg.resend.Sub(now); d < next {
+				next = d
+			}
+		}
+		c.mutex.Unlock()
+
+		if next < time.Millisecond {
+			next = time.Millisecond
+		}
+		timer.Reset(next)
+	}
+}
+
+func (c *Conn) wait(event chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrDeadline
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	c.mutex.Unlock()
+	defer c.mutex.Lock()
+
+	select {
+	case <-event:
+		return nil
+	case <-timeout:
+		return ErrDeadline
+	case <-c.closeChan:
+		return nil
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for len(c.readBuf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if len(c.rcvQueue) > 0 {
+			wasFull := c.window() == 0
+			c.readBuf = c.rcvQueue[0]
+			c.rcvQueue[0] = nil
+			c.rcvQueue = c.rcvQueue[1:]
+			if c.readBuf == nil {
+				c.eof = true
+			}
+			if wasFull {
+				c.send(cmdPong, 0, nil)
+			}
+			continue
+		}
+		if c.closed {
+			return 0, c.closeErr
+		}
+		if err := c.wait(c.readEvent, c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.closed {
+			return written, c.closeErr
+		}
+		if c.finSent {
+			return written, net.ErrClosed
+		}
+		if len(c.sndQueue) >= windowSize {
+			if err := c.wait(c.writeEvent, c.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := len(b) - written
+		if n > mss {
+			n = mss
+		}
+		c.sndQueue = append(c.sndQueue, &segment{
+			cmd:  cmdPush,
+			data: append([]byte(nil), b[written:written+n]...),
+		})
+		written += n
+	}
+	c.flush()
+	notify(c.kick)
+	return written, nil
+}
+
+// Close sends a FIN after the queued data and waits a short time for the
+// peer to acknowledge everything. When the peer has closed first only the
+// data is waited for, the peer is gone before it could acknowledge our FIN.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	if !c.finSent {
+		c.finSent = true
+		c.sndQueue = append(c.sndQueue, &segment{cmd: cmdFin})
+		c.flush()
+		notify(c.kick)
+
+		deadline := time.Now().Add(lingerTime)
+		for !c.closed && c.pending() > 0 {
+			if c.wait(c.writeEvent, deadline) != nil {
+				break
+			}
+		}
+	}
+	c.closeLocked(net.ErrClosed)
+	return nil
+}
+
+func (c *Conn) pending() int {
+	n := len(c.sndQueue) + len(c.sndBuf)
+	if c.finRecv && n > 0 {
+		n--
+	}
+	return n
+}
+
+func (c *Conn) closeLocked(err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeErr = err
+	close(c.closeChan)
+	if c.onClose != nil {
+		go c.onClose()
+	}
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writeDeadline = t
+	return nil
+}
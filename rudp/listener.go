@@ -0,0 +1,228 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	acceptBacklog    = 128
+	handshakeTimeout = 5 * time.Second
+	handshakeResend  = 200 * time.Millisecond
+)
+
+type connKey struct {
+	addr string
+	conv uint32
+}
+
+// Listener accepts Conns on one PacketConn, packets are dispatched by the
+// remote address and the connection ID chosen by the client.
+type Listener struct {
+	conn net.PacketConn
+
+	mutex sync.Mutex
+	conns map[connKey]*Conn
+
+	acceptChan chan *Conn
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+	err        error
+}
+
+func Listen(network, address string) (*Listener, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(conn), nil
+}
+
+func NewListener(conn net.PacketConn) *Listener {
+	l := &Listener{
+		conn:       conn,
+		conns:      make(map[connKey]*Conn),
+		acceptChan: make(chan *Conn, acceptBacklog),
+		closeChan:  make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			l.close(err)
+			return
+		}
+		h, data, err := decode(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		key := connKey{addr.String(), h.conv}
+		l.mutex.Lock()
+		c, exists := l.conns[key]
+		if !exists && h.cmd == cmdSyn {
+			c = l.newConn(key, addr)
+			select {
+			case l.acceptChan <- c:
+				l.conns[key] = c
+			default:
+				c = nil
+			}
+		}
+		l.mutex.Unlock()
+
+		if c == nil {
+			if !exists && h.cmd != cmdSyn && h.cmd != cmdRst {
+				l.reset(h.conv, addr)
+			}
+			continue
+		}
+		if h.cmd == cmdSyn {
+			c.mutex.Lock()
+			c.send(cmdSynAck, 0, nil)
+			c.mutex.Unlock()
+			continue
+		}
+		c.input(h, data)
+	}
+}
+
+func (l *Listener) newConn(key connKey, addr net.Addr) *Conn {
+	var c *Conn
+	c = newConn(key.conv, l.conn.LocalAddr(), addr, func(b []byte) error {
+		_, err := l.conn.WriteTo(b, addr)
+		return err
+	}, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+	})
+	return c
+}
+
+// reset tells the peer of an unknown connection to give up, e.g. after the
+// listener restarted.
+func (l *Listener) reset(conv uint32, addr net.Addr) {
+	var b [headerSize]byte
+	h := header{conv: conv, cmd: cmdRst}
+	h.encode(b[:], 0)
+	l.conn.WriteTo(b[:], addr)
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.acceptChan:
+		return c, nil
+	case <-l.closeChan:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.close(net.ErrClosed)
+}
+
+func (l *Listener) close(reason error) error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		l.err = reason
+		close(l.closeChan)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func Dial(network, address string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := client(conn, raddr, func() {
+		conn.Close()
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Client starts a Conn to raddr over conn, packets from other addresses are
+// ignored. The caller owns conn.
+func Client(conn net.PacketConn, raddr net.Addr) (*Conn, error) {
+	return client(conn, raddr, nil)
+}
+
+func client(conn net.PacketConn, raddr net.Addr, onClose func()) (*Conn, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	conv := binary.BigEndian.Uint32(b[:])
+
+	c := newConn(conv, conn.LocalAddr(), raddr, func(b []byte) error {
+		_, err := conn.WriteTo(b, raddr)
+		return err
+	}, onClose)
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				c.mutex.Lock()
+				c.closeLocked(err)
+				c.mutex.Unlock()
+				return
+			}
+			if addr.String() != raddr.String() {
+				continue
+			}
+			h, data, err := decode(buf[:n])
+			if err != nil || h.conv != conv {
+				continue
+			}
+			c.input(h, data)
+		}
+	}()
+
+	deadline := time.Now().Add(handshakeTimeout)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for !c.established {
+		if c.closed {
+			return nil, c.closeErr
+		}
+		if time.Now().After(deadline) {
+			c.closeLocked(ErrTimeout)
+			return nil, ErrTimeout
+		}
+		c.send(cmdSyn, 0, nil)
+		c.wait(c.writeEvent, time.Now().Add(handshakeResend))
+	}
+	return c, nil
+}
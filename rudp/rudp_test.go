@@ -0,0 +1,112 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/funny/utest"
+)
+
+type TestMsg struct {
+	N    int
+	Data string
+}
+
+// lossyConn drops a part of the outgoing packets.
+type lossyConn struct {
+	net.PacketConn
+	mutex sync.Mutex
+	rand  *rand.Rand
+	loss  float64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	drop := c.rand.Float64() < c.loss
+	c.mutex.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func lossy(conn net.PacketConn, seed int64) *lossyConn {
+	return &lossyConn{PacketConn: conn, rand: rand.New(rand.NewSource(seed)), loss: 0.1}
+}
+
+func Test_RUDP(t *testing.T) {
+	json := codec.Json()
+	json.Register(TestMsg{})
+	protocol := codec.FixLen(json, 4, binary.BigEndian, 1024*1024, 1024*1024)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	listener := NewListener(lossy(pc, 1))
+
+	server := link.NewServer(listener, protocol, 1024, link.HandlerFunc(func(session *link.Session) {
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	cpc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	defer cpc.Close()
+	conn, err := Client(lossy(cpc, 2), pc.LocalAddr())
+	utest.IsNilNow(t, err)
+
+	c, err := protocol.NewCodec(conn)
+	utest.IsNilNow(t, err)
+	session := link.NewSession(c, 0)
+	defer session.Close()
+
+	for i := 0; i < 50; i++ {
+		data := strings.Repeat("x", i*200)
+		utest.IsNilNow(t, session.Send(&TestMsg{i, data}))
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, msg.(*TestMsg).N, i)
+		utest.EqualNow(t, msg.(*TestMsg).Data, data)
+	}
+}
+
+func Test_RUDPReset(t *testing.T) {
+	listener, err := Listen("udp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	addr := listener.Addr().String()
+
+	conn, err := Dial("udp", addr)
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a"))
+	utest.IsNilNow(t, err)
+	_, err = listener.Accept()
+	utest.IsNilNow(t, err)
+
+	// A restarted listener does not know the connection.
+	listener.Close()
+	listener, err = Listen("udp", addr)
+	utest.IsNilNow(t, err)
+	defer listener.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("b"))
+	utest.IsNilNow(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	utest.Assert(t, err == ErrReset)
+}
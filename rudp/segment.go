@@ -0,0 +1,90 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	cmdSyn    = 1
+	cmdSynAck = 2
+	cmdPush   = 3
+	cmdAck    = 4
+	cmdFin    = 5
+	cmdPing   = 6
+	cmdPong   = 7
+	cmdRst    = 8 // the peer does not know the connection
+)
+
+const (
+	mtu        = 1400
+	headerSize = 17
+	mss        = mtu - headerSize
+
+	windowSize   = 256
+	fastResend   = 3
+	maxXmit      = 20
+	minRTO       = 30 * time.Millisecond
+	maxRTO       = 5 * time.Second
+	initRTO      = 200 * time.Millisecond
+	keepalive    = 5 * time.Second
+	idleTimeout  = 30 * time.Second
+	probeTimeout = 200 * time.Millisecond
+	lingerTime   = 3 * time.Second
+)
+
+var errBadPacket = errors.New("RUDP Bad Packet")
+
+// packet header: [conv 4][cmd 1][sn 4][una 4][wnd 2][len 2]
+type header struct {
+	conv uint32
+	cmd  byte
+	sn   uint32
+	una  uint32
+	wnd  uint16
+}
+
+func (h *header) encode(b []byte, size int) {
+	binary.BigEndian.PutUint32(b[0:], h.conv)
+	b[4] = h.cmd
+	binary.BigEndian.PutUint32(b[5:], h.sn)
+	binary.BigEndian.PutUint32(b[9:], h.una)
+	binary.BigEndian.PutUint16(b[13:], h.wnd)
+	binary.BigEndian.PutUint16(b[15:], uint16(size))
+}
+
+func decode(b []byte) (h header, data []byte, err error) {
+	if len(b) < headerSize {
+		err = errBadPacket
+		return
+	}
+	h.conv = binary.BigEndian.Uint32(b[0:])
+	h.cmd = b[4]
+	h.sn = binary.BigEndian.Uint32(b[5:])
+	h.una = binary.BigEndian.Uint32(b[9:])
+	h.wnd = binary.BigEndian.Uint16(b[13:])
+	size := int(binary.BigEndian.Uint16(b[15:]))
+	if len(b)-headerSize < size {
+		err = errBadPacket
+		return
+	}
+	data = b[headerSize : headerSize+size]
+	return
+}
+
+type segment struct {
+	cmd     byte
+	sn      uint32
+	data    []byte
+	sentAt  time.Time
+	resend  time.Time
+	rto     time.Duration
+	xmit    int
+	fastack int
+}
+
+// diff compares sequence numbers with wrap around.
+func diff(a, b uint32) int32 {
+	return int32(a - b)
+}
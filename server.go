@@ -1,6 +1,15 @@
 package link
 
-import "net"
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ServerStoppedError = errors.New("Server Stopped")
+var ServerNoListenerError = errors.New("Server No Listener")
 
 type Server struct {
 	manager      *Manager
@@ -8,6 +17,21 @@ type Server struct {
 	protocol     Protocol
 	handler      Handler
 	sendChanSize int
+
+	auth        Authenticator
+	authTimeout time.Duration
+	recvLimit   RateLimit
+	sendLimit   RateLimit
+
+	batchSize    int
+	batchLatency time.Duration
+
+	tlsHandshakeTimeout time.Duration
+
+	listenerMutex sync.Mutex
+	listeners     []net.Listener
+	stopped       bool
+	authSessions  map[*Session]struct{}
 }
 
 type Handler interface {
@@ -22,37 +46,123 @@ func (f HandlerFunc) HandleSession(session *Session) {
 	f(session)
 }
 
+// NewServer creates a Server on listener, more listeners can be served with
+// ServeListener. listener may be nil if all of them are added that way.
 func NewServer(listener net.Listener, protocol Protocol, sendChanSize int, handler Handler) *Server {
-	return &Server{
+	server := &Server{
 		manager:      NewManager(),
 		listener:     listener,
 		protocol:     protocol,
 		handler:      handler,
 		sendChanSize: sendChanSize,
+
+		tlsHandshakeTimeout: 10 * time.Second,
+	}
+	if listener != nil {
+		server.listeners = []net.Listener{listener}
 	}
+	return server
+}
+
+func (server *Server) Manager() *Manager {
+	return server.manager
 }
 
 func (server *Server) Listener() net.Listener {
 	return server.listener
 }
 
+// Listeners returns the listeners given to NewServer and ServeListener.
+func (server *Server) Listeners() []net.Listener {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	return append([]net.Listener(nil), server.listeners...)
+}
+
 func (server *Server) Serve() error {
+	if server.listener == nil {
+		return ServerNoListenerError
+	}
+	return server.serve(server.listener)
+}
+
+// ServeListener accepts sessions from one more listener until it fails or
+// the server is stopped. All the listeners share the Manager and the handler.
+func (server *Server) ServeListener(listener net.Listener) error {
+	server.listenerMutex.Lock()
+	if server.stopped {
+		server.listenerMutex.Unlock()
+		listener.Close()
+		return ServerStoppedError
+	}
+	server.listeners = append(server.listeners, listener)
+	server.listenerMutex.Unlock()
+
+	return server.serve(listener)
+}
+
+func (server *Server) serve(listener net.Listener) error {
 	for {
-		conn, err := Accept(server.listener)
+		conn, err := Accept(listener)
 		if err != nil {
 			return err
 		}
+		go server.serveConn(conn)
+	}
+}
 
-		go func() {
-			codec, err := server.protocol.NewCodec(conn)
-			if err != nil {
-				conn.Close()
-				return
-			}
-			session := server.manager.NewSession(codec, server.sendChanSize)
-			server.handler.HandleSession(session)
-		}()
+func (server *Server) serveConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if server.tlsHandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(server.tlsHandshakeTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	var counter *countingConn
+	var rw net.Conn = conn
+	if server.recvLimit.enabled() || server.sendLimit.enabled() {
+		counter = &countingConn{Conn: conn}
+		rw = counter
+	}
+	codec, err := server.protocol.NewCodec(rw)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	session := newSession(server.manager, codec, server.sendChanSize)
+	session.conn = conn
+	if server.recvLimit.enabled() {
+		session.recvLimit = newRateLimiter(server.recvLimit, counter.readCount)
+	}
+	if server.sendLimit.enabled() {
+		session.sendLimit = newRateLimiter(server.sendLimit, counter.writeCount)
+	}
+	session.SetBatch(server.batchSize, server.batchLatency)
+	session.start()
+	if server.authenticate(session) != nil {
+		return
 	}
+	server.manager.putSession(session)
+	server.handler.HandleSession(session)
+}
+
+// SetBatch makes the async sessions encode up to maxMessages queued messages
+// before one flush when the codec is a BufferedCodec. A batch waits at most
+// maxLatency for more messages, 0 means it only takes the queued ones.
+// It must be called before Serve.
+func (server *Server) SetBatch(maxMessages int, maxLatency time.Duration) {
+	server.batchSize = maxMessages
+	server.batchLatency = maxLatency
+}
+
+// SetTLSHandshakeTimeout limits the TLS handshake of new connections, the
+// default is 10 seconds and 0 means no limit. It must be called before Serve.
+func (server *Server) SetTLSHandshakeTimeout(timeout time.Duration) {
+	server.tlsHandshakeTimeout = timeout
 }
 
 func (server *Server) GetSession(sessionID uint64) *Session {
@@ -60,6 +170,21 @@ func (server *Server) GetSession(sessionID uint64) *Session {
 }
 
 func (server *Server) Stop() {
-	server.listener.Close()
+	server.listenerMutex.Lock()
+	server.stopped = true
+	listeners := server.listeners
+	server.listeners = nil
+	authSessions := make([]*Session, 0, len(server.authSessions))
+	for session := range server.authSessions {
+		authSessions = append(authSessions, session)
+	}
+	server.listenerMutex.Unlock()
+
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	for _, session := range authSessions {
+		session.Close()
+	}
 	server.manager.Dispose()
 }
@@ -1,21 +1,25 @@
 package link
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var SessionClosedError = errors.New("Session Closed")
 var SessionBlockedError = errors.New("Session Blocked")
-
-var globalSessionId uint64
+var InvalidPriorityError = errors.New("Invalid Priority")
 
 type Session struct {
 	id        uint64
+	conn      net.Conn
 	codec     Codec
 	manager   *Manager
-	sendChan  chan interface{}
+	sendChans []chan interface{}
 	recvMutex sync.Mutex
 	sendMutex sync.RWMutex
 
@@ -25,27 +29,54 @@ type Session struct {
 	firstCloseCallback *closeCallback
 	lastCloseCallback  *closeCallback
 
+	channelMutex sync.Mutex
+	channels     []Membership
+
+	identity interface{}
+
+	recvLimit *rateLimiter
+	sendLimit *rateLimiter
+
+	batchSize    int32 // atomic
+	batchLatency int64 // atomic, time.Duration
+
 	State interface{}
 }
 
 func NewSession(codec Codec, sendChanSize int) *Session {
-	return newSession(nil, codec, sendChanSize)
+	session := newSession(nil, codec, sendChanSize)
+	session.start()
+	return session
 }
 
 func newSession(manager *Manager, codec Codec, sendChanSize int) *Session {
+	var ids IDGenerator = counterID
+	if manager != nil && manager.ids != nil {
+		ids = manager.ids
+	}
 	session := &Session{
 		codec:     codec,
 		manager:   manager,
 		closeChan: make(chan int),
-		id:        atomic.AddUint64(&globalSessionId, 1),
+		id:        ids.NextID(),
 	}
 	if sendChanSize > 0 {
-		session.sendChan = make(chan interface{}, sendChanSize)
-		go session.sendLoop()
+		session.sendChans = make([]chan interface{}, numPriorities)
+		for i := range session.sendChans {
+			session.sendChans[i] = make(chan interface{}, sendChanSize)
+		}
 	}
 	return session
 }
 
+// start runs the send loop of an async session, the session must be fully
+// configured before.
+func (session *Session) start() {
+	if session.sendChans != nil {
+		go session.sendLoop()
+	}
+}
+
 func (session *Session) ID() uint64 {
 	return session.id
 }
@@ -58,11 +89,15 @@ func (session *Session) Close() error {
 	if atomic.CompareAndSwapInt32(&session.closeFlag, 0, 1) {
 		close(session.closeChan)
 
-		if session.sendChan != nil {
+		if session.sendChans != nil {
 			session.sendMutex.Lock()
-			close(session.sendChan)
+			for _, sendChan := range session.sendChans {
+				close(sendChan)
+			}
 			if clear, ok := session.codec.(ClearSendChan); ok {
-				clear.ClearSendChan(session.sendChan)
+				for _, sendChan := range session.sendChans {
+					clear.ClearSendChan(sendChan)
+				}
 			}
 			session.sendMutex.Unlock()
 		}
@@ -85,33 +120,224 @@ func (session *Session) Codec() Codec {
 	return session.codec
 }
 
+// Conn returns the connection of a session created by Server or Dial,
+// nil for the sessions created by NewSession.
+func (session *Session) Conn() net.Conn {
+	return session.conn
+}
+
+func (session *Session) TLSConnectionState() (tls.ConnectionState, bool) {
+	if conn, ok := session.conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+func (session *Session) PeerCertificates() []*x509.Certificate {
+	state, _ := session.TLSConnectionState()
+	return state.PeerCertificates
+}
+
 func (session *Session) Receive() (interface{}, error) {
 	session.recvMutex.Lock()
 	defer session.recvMutex.Unlock()
 
-	msg, err := session.codec.Receive()
-	if err != nil {
-		session.Close()
+	for {
+		msg, err := session.codec.Receive()
+		if err != nil {
+			session.Close()
+			return msg, err
+		}
+		if session.recvLimit == nil {
+			return msg, nil
+		}
+		session.recvLimit.charge()
+		switch err := session.recvLimit.admit(session.closeChan, nil); err {
+		case nil:
+			return msg, nil
+		case errRateDrop:
+		default:
+			session.Close()
+			return nil, err
+		}
+	}
+}
+
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+	numPriorities
+)
+
+// Pending returns the number of messages queued in all the lanes.
+func (session *Session) Pending() int {
+	n := 0
+	for _, sendChan := range session.sendChans {
+		n += len(sendChan)
+	}
+	return n
+}
+
+// closeAfterSend is queued by sendAndClose behind the last message.
+type closeAfterSend struct{}
+
+const (
+	laneMessage = iota
+	laneEmpty
+	laneClosed
+)
+
+// next takes a message from the lanes strictly by priority, a lower lane is
+// only read when the higher ones are empty. It waits for a message until
+// timeout if block is true, timeout may be nil to wait forever.
+func (session *Session) next(block bool, timeout <-chan time.Time) (interface{}, int) {
+	high := session.sendChans[PriorityHigh]
+	normal := session.sendChans[PriorityNormal]
+	low := session.sendChans[PriorityLow]
+
+	var msg interface{}
+	var ok bool
+	select {
+	case msg, ok = <-high:
+	default:
+		select {
+		case msg, ok = <-high:
+		case msg, ok = <-normal:
+		default:
+			if block {
+				select {
+				case msg, ok = <-high:
+				case msg, ok = <-normal:
+				case msg, ok = <-low:
+				case <-timeout:
+					return nil, laneEmpty
+				case <-session.closeChan:
+					return nil, laneClosed
+				}
+			} else {
+				select {
+				case msg, ok = <-high:
+				case msg, ok = <-normal:
+				case msg, ok = <-low:
+				default:
+					return nil, laneEmpty
+				}
+			}
+		}
+	}
+	if !ok {
+		return nil, laneClosed
 	}
-	return msg, err
+	return msg, laneMessage
 }
 
 func (session *Session) sendLoop() {
 	defer session.Close()
+	codec, buffered := session.codec.(BufferedCodec)
 	for {
-		select {
-		case msg, ok := <-session.sendChan:
-			if !ok || session.codec.Send(msg) != nil {
+		msg, state := session.next(true, nil)
+		if state != laneMessage {
+			return
+		}
+		if size, latency := session.batch(); buffered && size > 1 {
+			if !session.sendBatch(codec, msg, size, latency) {
 				return
 			}
-		case <-session.closeChan:
+			continue
+		}
+		if _, done := msg.(closeAfterSend); done {
 			return
 		}
+		if err := session.send(msg, session.codec.Send, nil); err != nil && err != errRateDrop {
+			return
+		}
+	}
+}
+
+// SetBatch makes an async session encode up to maxMessages queued messages
+// before one flush when its codec is a BufferedCodec. A batch waits at most
+// maxLatency for more messages, 0 means it only takes the queued ones.
+// It applies from the next batch and can be used on the sessions of Dial,
+// NewSession, Client and Pool, see Server.SetBatch for the server sessions.
+func (session *Session) SetBatch(maxMessages int, maxLatency time.Duration) {
+	atomic.StoreInt32(&session.batchSize, int32(maxMessages))
+	atomic.StoreInt64(&session.batchLatency, int64(maxLatency))
+}
+
+func (session *Session) batch() (int, time.Duration) {
+	return int(atomic.LoadInt32(&session.batchSize)), time.Duration(atomic.LoadInt64(&session.batchLatency))
+}
+
+// sendBatch encodes msg and the messages queued behind it, up to size or
+// until no message comes within latency, then flushes them at once.
+func (session *Session) sendBatch(codec BufferedCodec, msg interface{}, size int, latency time.Duration) bool {
+	var timeout <-chan time.Time
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for n := 1; ; n++ {
+		if _, done := msg.(closeAfterSend); done {
+			codec.Flush()
+			return false
+		}
+		// The encoded messages are flushed before a RateDelay wait, so the
+		// wait does not hold them longer than latency.
+		if err := session.send(msg, codec.SendBuffered, codec.Flush); err != nil && err != errRateDrop {
+			return false
+		}
+		if n >= size {
+			break
+		}
+		var state int
+		msg, state = session.next(timeout != nil, timeout)
+		if state == laneEmpty {
+			break
+		}
+		if state == laneClosed {
+			codec.Flush()
+			return false
+		}
+	}
+	return codec.Flush() == nil
+}
+
+// send applies the send rate limit and encodes msg with encode, it is called
+// by Send or by sendLoop. flush may be nil, it runs before waiting for the
+// limit.
+func (session *Session) send(msg interface{}, encode func(interface{}) error, flush func() error) error {
+	if session.sendLimit == nil {
+		return encode(msg)
+	}
+	if err := session.sendLimit.admit(session.closeChan, flush); err != nil {
+		return err
 	}
+	err := encode(msg)
+	session.sendLimit.charge()
+	return err
 }
 
 func (session *Session) Send(msg interface{}) error {
-	if session.sendChan == nil {
+	return session.SendPriority(msg, PriorityNormal)
+}
+
+// SendPriority queues msg in the lane of priority, the messages of a higher
+// lane are sent first. A sync session sends msg immediately.
+// Every lane holds up to sendChanSize messages, so an async session can
+// queue three times sendChanSize messages in all. A priority out of
+// PriorityHigh to PriorityLow fails with InvalidPriorityError.
+func (session *Session) SendPriority(msg interface{}, priority Priority) error {
+	if priority < PriorityHigh || priority >= numPriorities {
+		return InvalidPriorityError
+	}
+	if session.sendChans == nil {
 		if session.IsClosed() {
 			return SessionClosedError
 		}
@@ -119,7 +345,10 @@ func (session *Session) Send(msg interface{}) error {
 		session.sendMutex.Lock()
 		defer session.sendMutex.Unlock()
 
-		err := session.codec.Send(msg)
+		err := session.send(msg, session.codec.Send, nil)
+		if err == errRateDrop {
+			return nil
+		}
 		if err != nil {
 			session.Close()
 		}
@@ -133,7 +362,7 @@ func (session *Session) Send(msg interface{}) error {
 	}
 
 	select {
-	case session.sendChan <- msg:
+	case session.sendChans[priority] <- msg:
 		session.sendMutex.RUnlock()
 		return nil
 	default:
@@ -143,6 +372,17 @@ func (session *Session) Send(msg interface{}) error {
 	}
 }
 
+// sendAndClose closes the session after msg and the messages queued before
+// it are sent. The sentinel goes to the lowest lane, which is read last.
+func (session *Session) sendAndClose(msg interface{}) {
+	if session.Send(msg) != nil {
+		return
+	}
+	if session.sendChans == nil || session.SendPriority(closeAfterSend{}, PriorityLow) != nil {
+		session.Close()
+	}
+}
+
 type closeCallback struct {
 	Handler interface{}
 	Key     interface{}
@@ -200,3 +440,39 @@ func (session *Session) invokeCloseCallbacks() {
 		callback.Func()
 	}
 }
+
+type Membership struct {
+	Channel *Channel
+	Key     KEY
+}
+
+func (session *Session) Channels() []Membership {
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
+	return append([]Membership(nil), session.channels...)
+}
+
+func (session *Session) LeaveAll() {
+	for _, m := range session.Channels() {
+		m.Channel.removeSession(m.Key, session, ChannelLeaveRemove)
+	}
+}
+
+func (session *Session) join(channel *Channel, key KEY) {
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
+	session.channels = append(session.channels, Membership{channel, key})
+}
+
+func (session *Session) leave(channel *Channel, key KEY) {
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
+	for i, m := range session.channels {
+		if m.Channel == channel && m.Key == key {
+			copy(session.channels[i:], session.channels[i+1:])
+			session.channels[len(session.channels)-1] = Membership{}
+			session.channels = session.channels[:len(session.channels)-1]
+			return
+		}
+	}
+}
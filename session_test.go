@@ -2,9 +2,14 @@ package link
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
+	"net"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -220,6 +225,556 @@ func Test_Channel(t *testing.T) {
 	server.Stop()
 }
 
+type preEncodeProtocol struct {
+	encodes int
+}
+
+type preEncodedMsg struct {
+	msg interface{}
+}
+
+func (p *preEncodeProtocol) PreEncode(msg interface{}) (interface{}, error) {
+	p.encodes++
+	return preEncodedMsg{msg}, nil
+}
+
+type memoryCodec struct {
+	protocol *preEncodeProtocol
+	sent     []interface{}
+	err      error
+}
+
+func (c *memoryCodec) PreEncoder() PreEncoder {
+	if c.protocol == nil {
+		return nil
+	}
+	return c.protocol
+}
+
+func (c *memoryCodec) Receive() (interface{}, error) {
+	return nil, io.EOF
+}
+
+func (c *memoryCodec) Send(msg interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.sent = append(c.sent, msg)
+	return nil
+}
+
+func (c *memoryCodec) Close() error {
+	return nil
+}
+
+func Test_Broadcast(t *testing.T) {
+	p1 := new(preEncodeProtocol)
+	p2 := new(preEncodeProtocol)
+
+	channel := NewChannel()
+	codecs := make([]*memoryCodec, 10)
+	for i := 0; i < 10; i++ {
+		codecs[i] = new(memoryCodec)
+		switch i % 3 {
+		case 0:
+			codecs[i].protocol = p1
+		case 1:
+			codecs[i].protocol = p2
+		}
+		channel.Put(i, NewSession(codecs[i], 0))
+	}
+	codecs[9].err = io.ErrClosedPipe
+
+	errs := channel.Broadcast("hello", func(session *Session) bool {
+		return session != channel.Get(8)
+	})
+	utest.EqualNow(t, len(errs), 1)
+	utest.EqualNow(t, errs[9], io.ErrClosedPipe)
+	utest.EqualNow(t, p1.encodes, 1)
+	utest.EqualNow(t, p2.encodes, 1)
+
+	for i := 0; i < 8; i++ {
+		utest.EqualNow(t, len(codecs[i].sent), 1)
+		if codecs[i].protocol == nil {
+			utest.EqualNow(t, codecs[i].sent[0], "hello")
+		} else {
+			utest.EqualNow(t, codecs[i].sent[0], preEncodedMsg{"hello"})
+		}
+	}
+	utest.EqualNow(t, len(codecs[8].sent), 0)
+}
+
+type preEncodeFunc func(interface{}) (interface{}, error)
+
+func (f preEncodeFunc) PreEncode(msg interface{}) (interface{}, error) {
+	return f(msg)
+}
+
+type funcEncoderCodec struct {
+	memoryCodec
+	encoder preEncodeFunc
+}
+
+func (c *funcEncoderCodec) PreEncoder() PreEncoder {
+	return c.encoder
+}
+
+func Test_BroadcastUncomparableEncoder(t *testing.T) {
+	encodes := 0
+	encoder := preEncodeFunc(func(msg interface{}) (interface{}, error) {
+		encodes++
+		return preEncodedMsg{msg}, nil
+	})
+
+	channel := NewChannel()
+	codecs := make([]*funcEncoderCodec, 3)
+	for i := range codecs {
+		codecs[i] = &funcEncoderCodec{encoder: encoder}
+		channel.Put(i, NewSession(codecs[i], 0))
+	}
+
+	errs := channel.Broadcast("hello", nil)
+	utest.EqualNow(t, len(errs), 0)
+	utest.EqualNow(t, encodes, 3)
+	for _, codec := range codecs {
+		utest.EqualNow(t, codec.sent[0], preEncodedMsg{"hello"})
+	}
+}
+
+func Test_ChannelWatcher(t *testing.T) {
+	events := make(chan ChannelEvent, 10)
+
+	channel := NewChannel()
+	channel.AddWatcher(1, func(event ChannelEvent) {
+		events <- event
+	})
+
+	session1 := NewSession(new(memoryCodec), 0)
+	session2 := NewSession(new(memoryCodec), 0)
+	session3 := NewSession(new(memoryCodec), 0)
+
+	channel.Put(1, session1)
+	utest.EqualNow(t, <-events, ChannelEvent{ChannelJoin, 1, session1})
+
+	channel.Put(1, session2)
+	utest.EqualNow(t, <-events, ChannelEvent{ChannelLeaveReplace, 1, session1})
+	utest.EqualNow(t, <-events, ChannelEvent{ChannelJoin, 1, session2})
+
+	channel.Remove(1)
+	utest.EqualNow(t, <-events, ChannelEvent{ChannelLeaveRemove, 1, session2})
+
+	channel.Put(2, session3)
+	utest.EqualNow(t, <-events, ChannelEvent{ChannelJoin, 2, session3})
+
+	session1.Close()
+	session3.Close()
+	utest.EqualNow(t, <-events, ChannelEvent{ChannelLeaveClose, 2, session3})
+	utest.EqualNow(t, channel.Len(), 0)
+
+	channel.RemoveWatcher(1)
+	channel.Put(3, session2)
+	utest.EqualNow(t, len(events), 0)
+}
+
+func Test_LeaveAll(t *testing.T) {
+	session := NewSession(new(memoryCodec), 0)
+	other := NewSession(new(memoryCodec), 0)
+
+	channels := make([]*Channel, 3)
+	for i := 0; i < len(channels); i++ {
+		channels[i] = NewChannel()
+		channels[i].Put(i, session)
+		channels[i].Put(-1, other)
+	}
+	channels[2].Remove(2)
+
+	utest.EqualNow(t, session.Channels(), []Membership{
+		{channels[0], 0},
+		{channels[1], 1},
+	})
+
+	session.LeaveAll()
+	utest.EqualNow(t, len(session.Channels()), 0)
+	for i := 0; i < len(channels); i++ {
+		utest.EqualNow(t, channels[i].Len(), 1)
+		utest.EqualNow(t, channels[i].Get(-1), other)
+	}
+	utest.EqualNow(t, len(other.Channels()), 3)
+}
+
+func Test_ChannelOf(t *testing.T) {
+	type roomState struct {
+		Name string
+	}
+
+	channel := NewChannelOf[string, roomState]()
+	channel.State.Name = "lobby"
+
+	var joined []string
+	channel.AddWatcher(1, func(event ChannelEventOf[string]) {
+		if event.Type == ChannelJoin {
+			joined = append(joined, event.Key)
+		}
+	})
+
+	session := NewSession(new(memoryCodec), 0)
+	session.State = 123
+	channel.Put("a", session)
+	channel.Put("b", NewSession(&memoryCodec{err: io.ErrClosedPipe}, 0))
+
+	utest.EqualNow(t, channel.Get("a"), session)
+	utest.EqualNow(t, joined, []string{"a", "b"})
+	utest.EqualNow(t, channel.Broadcast("hi", nil), map[string]error{"b": io.ErrClosedPipe})
+	utest.Assert(t, channel.Remove("a"))
+	utest.EqualNow(t, channel.Get("a"), nil)
+
+	state, ok := StateOf[int](session)
+	utest.Assert(t, ok)
+	utest.EqualNow(t, state, 123)
+
+	_, ok = StateOf[string](session)
+	utest.Assert(t, !ok)
+}
+
+func Test_ManagerRange(t *testing.T) {
+	manager := NewManager()
+	codecs := make(map[uint64]*memoryCodec)
+	for i := 0; i < 100; i++ {
+		codec := new(memoryCodec)
+		session := manager.NewSession(codec, 0)
+		codecs[session.ID()] = codec
+	}
+	utest.EqualNow(t, manager.Len(), 100)
+
+	n := 0
+	manager.Range(func(session *Session) bool {
+		n++
+		return n < 10
+	})
+	utest.EqualNow(t, n, 10)
+
+	var target uint64
+	for id := range codecs {
+		target = id
+		break
+	}
+	session := manager.FindSession(func(session *Session) bool {
+		return session.ID() == target
+	})
+	utest.EqualNow(t, session, manager.GetSession(target))
+
+	errs := manager.Broadcast("hello", func(session *Session) bool {
+		return session.ID() != target
+	})
+	utest.EqualNow(t, len(errs), 0)
+	for id, codec := range codecs {
+		if id == target {
+			utest.EqualNow(t, len(codec.sent), 0)
+		} else {
+			utest.EqualNow(t, codec.sent, []interface{}{"hello"})
+		}
+	}
+
+	manager.Dispose()
+	utest.EqualNow(t, manager.Len(), 0)
+}
+
+func Test_IDGenerator(t *testing.T) {
+	ids := Snowflake(3)
+	seen := make(map[uint64]bool)
+	for i := 0; i < 10000; i++ {
+		id := ids.NextID()
+		utest.Assert(t, !seen[id])
+		utest.EqualNow(t, id>>12&1023, uint64(3))
+		seen[id] = true
+	}
+
+	manager := NewManager()
+	manager.SetIDGenerator(Snowflake(1))
+	for i := 0; i < 1000; i++ {
+		manager.NewSession(new(memoryCodec), 0)
+	}
+	utest.EqualNow(t, manager.Len(), 1000)
+	for i := 0; i < sessionMapNum; i++ {
+		utest.Assert(t, len(manager.sessionMaps[i].sessions) > 0)
+	}
+
+	manager = NewManager()
+	manager.SetIDGenerator(IDGeneratorFunc(func() uint64 {
+		return 42
+	}))
+	session1 := manager.NewSession(new(memoryCodec), 0)
+	session2 := manager.NewSession(new(memoryCodec), 0)
+	utest.Assert(t, session2.IsClosed())
+	utest.EqualNow(t, manager.GetSession(42), session1)
+}
+
+type pipeConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *pipeConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+func Test_DialWith(t *testing.T) {
+	var conns []*pipeConn
+	dialer := DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		utest.EqualNow(t, network, "pipe")
+		utest.EqualNow(t, address, "test")
+		c1, c2 := net.Pipe()
+		go func() {
+			codec, _ := NewTestCodec(c2)
+			session := NewSession(codec, 0)
+			for {
+				msg, err := session.Receive()
+				if err != nil {
+					return
+				}
+				session.Send(msg)
+			}
+		}()
+		conn := &pipeConn{Conn: c1}
+		conns = append(conns, conn)
+		return conn, nil
+	})
+
+	session, err := DialWith(context.Background(), dialer, "pipe", "test", ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	BytesTest(t, session)
+	session.Close()
+
+	codecErr := errors.New("codec error")
+	_, err = DialWith(context.Background(), dialer, "pipe", "test", ProtocolFunc(func(rw io.ReadWriter) (Codec, error) {
+		return nil, codecErr
+	}), 0)
+	utest.EqualNow(t, err, codecErr)
+	utest.Assert(t, conns[1].closed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = DialContext(ctx, "tcp", "127.0.0.1:1", ProtocolFunc(NewTestCodec), 0)
+	utest.Assert(t, errors.Is(err, context.Canceled))
+}
+
+func Test_MultiListener(t *testing.T) {
+	server := NewServer(nil, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	utest.EqualNow(t, server.Serve(), ServerNoListenerError)
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "link.sock"))
+	utest.IsNilNow(t, err)
+
+	served := make(chan error, 2)
+	for _, listener := range []net.Listener{tcp, unix} {
+		go func(listener net.Listener) {
+			served <- server.ServeListener(listener)
+		}(listener)
+	}
+
+	var sessions []*Session
+	for _, listener := range []net.Listener{tcp, unix} {
+		addr := listener.Addr()
+		session, err := Dial(addr.Network(), addr.String(), ProtocolFunc(NewTestCodec), 0)
+		utest.IsNilNow(t, err)
+		BytesTest(t, session)
+		sessions = append(sessions, session)
+	}
+	utest.EqualNow(t, server.Manager().Len(), 2)
+	utest.EqualNow(t, len(server.Listeners()), 2)
+
+	server.Stop()
+	utest.NotNilNow(t, <-served)
+	utest.NotNilNow(t, <-served)
+	for _, session := range sessions {
+		_, err := session.Receive()
+		utest.NotNilNow(t, err)
+	}
+
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, server.ServeListener(other), ServerStoppedError)
+}
+
+type gateCodec struct {
+	gate chan struct{}
+	sent chan interface{}
+}
+
+func (c *gateCodec) Receive() (interface{}, error) {
+	return nil, io.EOF
+}
+
+func (c *gateCodec) Send(msg interface{}) error {
+	<-c.gate
+	c.sent <- msg
+	return nil
+}
+
+func (c *gateCodec) Close() error {
+	return nil
+}
+
+func Test_SendPriority(t *testing.T) {
+	codec := &gateCodec{
+		gate: make(chan struct{}),
+		sent: make(chan interface{}, 100),
+	}
+	session := NewSession(codec, 10)
+	defer session.Close()
+
+	// The first message holds sendLoop in the codec while the lanes fill.
+	utest.IsNilNow(t, session.Send("first"))
+	for session.Pending() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		utest.IsNilNow(t, session.SendPriority(fmt.Sprint("low", i), PriorityLow))
+		utest.IsNilNow(t, session.SendPriority(fmt.Sprint("normal", i), PriorityNormal))
+		utest.IsNilNow(t, session.SendPriority(fmt.Sprint("high", i), PriorityHigh))
+	}
+	utest.EqualNow(t, session.Pending(), 9)
+	close(codec.gate)
+
+	expect := []string{"first", "high0", "high1", "high2", "normal0", "normal1", "normal2", "low0", "low1", "low2"}
+	for _, e := range expect {
+		utest.EqualNow(t, <-codec.sent, e)
+	}
+
+	// Every lane has its own size.
+	gate := make(chan struct{})
+	defer close(gate)
+	blocked := NewSession(&gateCodec{gate: gate, sent: make(chan interface{}, 1)}, 1)
+	utest.IsNilNow(t, blocked.Send("first"))
+	for blocked.Pending() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, blocked.SendPriority("low", PriorityLow))
+	utest.IsNilNow(t, blocked.SendPriority("high", PriorityHigh))
+	utest.EqualNow(t, blocked.SendPriority("high", PriorityHigh), SessionBlockedError)
+	utest.Assert(t, blocked.IsClosed())
+
+	// A priority out of the lanes is refused, the session stays open.
+	utest.EqualNow(t, session.SendPriority("x", numPriorities), InvalidPriorityError)
+	utest.EqualNow(t, session.SendPriority("x", -1), InvalidPriorityError)
+	utest.Assert(t, !session.IsClosed())
+}
+
+func Test_SendAndCloseLanes(t *testing.T) {
+	codec := &gateCodec{
+		gate: make(chan struct{}),
+		sent: make(chan interface{}, 100),
+	}
+	session := NewSession(codec, 10)
+
+	utest.IsNilNow(t, session.Send("first"))
+	for session.Pending() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	utest.IsNilNow(t, session.SendPriority("low", PriorityLow))
+	session.sendAndClose("last")
+	close(codec.gate)
+
+	for _, e := range []string{"first", "last", "low"} {
+		utest.EqualNow(t, <-codec.sent, e)
+	}
+	for !session.IsClosed() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type batchCodec struct {
+	gateCodec
+	buffered []interface{}
+	flushes  chan []interface{}
+}
+
+func (c *batchCodec) SendBuffered(msg interface{}) error {
+	c.buffered = append(c.buffered, msg)
+	return nil
+}
+
+func (c *batchCodec) Flush() error {
+	<-c.gate
+	c.flushes <- c.buffered
+	c.buffered = nil
+	return nil
+}
+
+func Test_SendBatch(t *testing.T) {
+	codec := &batchCodec{
+		gateCodec: gateCodec{gate: make(chan struct{})},
+		flushes:   make(chan []interface{}, 100),
+	}
+	session := newSession(nil, codec, 100)
+	session.SetBatch(4, 0)
+	session.start()
+	defer session.Close()
+
+	// The first batch holds sendLoop in Flush while the lanes fill.
+	utest.IsNilNow(t, session.Send(0))
+	for session.Pending() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < 10; i++ {
+		utest.IsNilNow(t, session.Send(i))
+	}
+	close(codec.gate)
+
+	utest.EqualNow(t, <-codec.flushes, []interface{}{0})
+	utest.EqualNow(t, <-codec.flushes, []interface{}{1, 2, 3, 4})
+	utest.EqualNow(t, <-codec.flushes, []interface{}{5, 6, 7, 8})
+	utest.EqualNow(t, <-codec.flushes, []interface{}{9})
+
+	// A batch waits for more messages up to the latency.
+	codec = &batchCodec{
+		gateCodec: gateCodec{gate: make(chan struct{})},
+		flushes:   make(chan []interface{}, 100),
+	}
+	close(codec.gate)
+	session = NewSession(codec, 100)
+	session.SetBatch(4, 50*time.Millisecond)
+	defer session.Close()
+
+	utest.IsNilNow(t, session.Send(0))
+	time.Sleep(10 * time.Millisecond)
+	utest.IsNilNow(t, session.Send(1))
+	utest.EqualNow(t, <-codec.flushes, []interface{}{0, 1})
+
+	// A rate limit wait flushes the messages encoded before it.
+	codec = &batchCodec{
+		gateCodec: gateCodec{gate: make(chan struct{})},
+		flushes:   make(chan []interface{}, 100),
+	}
+	close(codec.gate)
+	session = newSession(nil, codec, 100)
+	session.sendLimit = newRateLimiter(RateLimit{Messages: 10, MessageBurst: 1}, nil)
+	session.SetBatch(4, 200*time.Millisecond)
+	utest.IsNilNow(t, session.Send(0))
+	utest.IsNilNow(t, session.Send(1))
+	start := time.Now()
+	session.start()
+	defer session.Close()
+
+	utest.EqualNow(t, <-codec.flushes, []interface{}{0})
+	utest.Assert(t, time.Since(start) < 50*time.Millisecond)
+	utest.EqualNow(t, <-codec.flushes, []interface{}{1})
+}
+
 func Benchmark_BytesToInterface(b *testing.B) {
 	var a = []byte{}
 	var x interface{}
@@ -0,0 +1,128 @@
+package link
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/funny/utest"
+)
+
+func newTestCert(t *testing.T, name string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	utest.IsNilNow(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	utest.IsNilNow(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	utest.IsNilNow(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func Test_TLS(t *testing.T) {
+	serverCert, serverX509 := newTestCert(t, "server")
+	clientCert, clientX509 := newTestCert(t, "client")
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(serverX509)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientX509)
+
+	peers := make(chan string, 1)
+	server, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		defer session.Close()
+		peers <- session.PeerCertificates()[0].Subject.CommonName
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	utest.IsNilNow(t, err)
+	go server.Serve()
+	defer server.Stop()
+
+	addr := server.Listener().Addr().String()
+
+	session, err := DialTLS("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      serverCAs,
+	}, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, <-peers, "client")
+
+	state, ok := session.TLSConnectionState()
+	utest.Assert(t, ok)
+	utest.Assert(t, state.HandshakeComplete)
+	utest.EqualNow(t, session.PeerCertificates()[0].Subject.CommonName, "server")
+	BytesTest(t, session)
+	session.Close()
+
+	session, err = DialTLS("tcp", addr, &tls.Config{
+		RootCAs: serverCAs,
+	}, ProtocolFunc(NewTestCodec), 0)
+	if err == nil {
+		// TLS 1.3 reports the missing client certificate after the handshake.
+		session.Send(RandBytes(10))
+		_, err = session.Receive()
+	}
+	utest.NotNilNow(t, err)
+
+	plain, err := Dial("tcp", addr, ProtocolFunc(NewTestCodec), 0)
+	utest.IsNilNow(t, err)
+	_, ok = plain.TLSConnectionState()
+	utest.Assert(t, !ok)
+	plain.Close()
+}
+
+func Test_TLSHandshakeTimeout(t *testing.T) {
+	serverCert, _ := newTestCert(t, "server")
+
+	server, err := ListenTLS("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	}, ProtocolFunc(NewTestCodec), 0, HandlerFunc(func(session *Session) {
+		session.Close()
+	}))
+	utest.IsNilNow(t, err)
+	server.SetTLSHandshakeTimeout(100 * time.Millisecond)
+	go server.Serve()
+	defer server.Stop()
+
+	// The client never sends a ClientHello.
+	conn, err := net.Dial("tcp", server.Listener().Addr().String())
+	utest.IsNilNow(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	utest.NotNilNow(t, err)
+	utest.Assert(t, time.Since(start) < time.Second)
+}
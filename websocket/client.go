@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+func Dial(rawurl string, messageType MessageType) (*Conn, error) {
+	return DialContext(context.Background(), rawurl, messageType, nil)
+}
+
+// DialContext connects to a ws:// or wss:// URL. The extra header is sent
+// with the handshake request, e.g. Origin or authentication cookies.
+func DialContext(ctx context.Context, rawurl string, messageType MessageType, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		dialer = new(net.Dialer)
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		dialer = &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+	default:
+		return nil, ErrBadHandshake
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := clientHandshake(conn, u, messageType, header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func clientHandshake(conn net.Conn, u *url.URL, messageType MessageType, header http.Header) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusSwitchingProtocols ||
+		rsp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, ErrBadHandshake
+	}
+	return newConn(conn, reader, true, messageType), nil
+}
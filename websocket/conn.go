@@ -0,0 +1,235 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrProtocol = errors.New("WebSocket Protocol Error")
+
+type MessageType byte
+
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+const (
+	opContinuation = 0
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// Conn adapts a WebSocket connection to net.Conn. Every Write is sent as one
+// message of the configured type, Read returns the payload of the incoming
+// messages as a continuous stream, so any link.Protocol can wrap it.
+type Conn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	client      bool
+	messageType MessageType
+
+	readMutex sync.Mutex
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	readErr   error
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, client bool, messageType MessageType) *Conn {
+	return &Conn{
+		conn:        conn,
+		reader:      reader,
+		client:      client,
+		messageType: messageType,
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for c.remaining == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if err := c.nextFrame(); err != nil {
+			c.readErr = err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *Conn) nextFrame() error {
+	var head [8]byte
+	if _, err := io.ReadFull(c.reader, head[:2]); err != nil {
+		return err
+	}
+	if head[0]&0x70 != 0 {
+		return ErrProtocol
+	}
+	opcode := head[0] & 0x0F
+	c.masked = head[1]&0x80 != 0
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.reader, head[:2]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint16(head[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.reader, head[:8]); err != nil {
+			return err
+		}
+		length = int64(binary.BigEndian.Uint64(head[:8]))
+		if length < 0 {
+			return ErrProtocol
+		}
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opContinuation, byte(TextMessage), byte(BinaryMessage):
+		c.remaining = length
+		return nil
+	case opPing, opPong, opClose:
+		if length > 125 {
+			return ErrProtocol
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case opPing:
+			return c.writeControl(opPong, payload)
+		case opClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeControl(opClose, payload)
+			return io.EOF
+		}
+		return nil
+	}
+	return ErrProtocol
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return 0, net.ErrClosed
+	}
+	if err := c.writeFrame(byte(c.messageType), p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *Conn) writeControl(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+	return c.writeFrame(opcode, payload)
+}
+
+func (c *Conn) writeFrame(opcode byte, p []byte) error {
+	var head [14]byte
+	head[0] = 0x80 | opcode
+	n := 2
+	switch {
+	case len(p) < 126:
+		head[1] = byte(len(p))
+	case len(p) <= 0xFFFF:
+		head[1] = 126
+		binary.BigEndian.PutUint16(head[2:], uint16(len(p)))
+		n = 4
+	default:
+		head[1] = 127
+		binary.BigEndian.PutUint64(head[2:], uint64(len(p)))
+		n = 10
+	}
+	if c.client {
+		head[1] |= 0x80
+		if _, err := rand.Read(head[n : n+4]); err != nil {
+			return err
+		}
+		masked := make([]byte, len(p))
+		for i := range p {
+			masked[i] = p[i] ^ head[n+(i&3)]
+		}
+		p = masked
+		n += 4
+	}
+	buffers := net.Buffers{head[:n], p}
+	_, err := buffers.WriteTo(c.conn)
+	return err
+}
+
+func (c *Conn) Close() error {
+	c.writeControl(opClose, []byte{0x03, 0xE8})
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var ErrBadHandshake = errors.New("WebSocket Bad Handshake")
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func hasToken(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade answers a WebSocket handshake and takes over the connection.
+// Origin checks, if needed, should be done on r before calling it.
+func Upgrade(w http.ResponseWriter, r *http.Request, messageType MessageType) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!hasToken(r.Header, "Connection", "upgrade") ||
+		!hasToken(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Bad WebSocket Handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket Not Supported", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, rw.Reader, false, messageType), nil
+}
+
+// Listener is an http.Handler which upgrades requests and hands the
+// connections to Accept, so a link.Server can serve WebSocket clients.
+type Listener struct {
+	addr        net.Addr
+	messageType MessageType
+	acceptChan  chan *Conn
+	closeChan   chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewListener(addr net.Addr, messageType MessageType) *Listener {
+	return &Listener{
+		addr:        addr,
+		messageType: messageType,
+		acceptChan:  make(chan *Conn),
+		closeChan:   make(chan struct{}),
+	}
+}
+
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.closeChan:
+		http.Error(w, "Server Closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	conn, err := Upgrade(w, r, l.messageType)
+	if err != nil {
+		return
+	}
+	select {
+	case l.acceptChan <- conn:
+	case <-l.closeChan:
+		conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptChan:
+		return conn, nil
+	case <-l.closeChan:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+		err = nil
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
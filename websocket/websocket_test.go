@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/funny/link"
+	"github.com/funny/link/codec"
+	"github.com/funny/utest"
+)
+
+type TestMsg struct {
+	Text string
+}
+
+func Test_WebSocket(t *testing.T) {
+	protocol := codec.Json()
+	protocol.Register(TestMsg{})
+
+	listener := NewListener(nil, TextMessage)
+	httpServer := httptest.NewServer(listener)
+	defer httpServer.Close()
+
+	server := link.NewServer(listener, protocol, 0, link.HandlerFunc(func(session *link.Session) {
+		defer session.Close()
+		for {
+			msg, err := session.Receive()
+			if err != nil {
+				return
+			}
+			if err := session.Send(msg); err != nil {
+				return
+			}
+		}
+	}))
+	go server.Serve()
+	defer server.Stop()
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http")
+	conn, err := Dial(url, TextMessage)
+	utest.IsNilNow(t, err)
+
+	c, err := protocol.NewCodec(conn)
+	utest.IsNilNow(t, err)
+	session := link.NewSession(c, 0)
+
+	for i := 0; i < 100; i++ {
+		text := strings.Repeat("x", i*1000)
+		utest.IsNilNow(t, session.Send(&TestMsg{text}))
+		msg, err := session.Receive()
+		utest.IsNilNow(t, err)
+		utest.EqualNow(t, msg.(*TestMsg).Text, text)
+	}
+	session.Close()
+}
+
+func Test_BadHandshake(t *testing.T) {
+	httpServer := httptest.NewServer(NewListener(nil, BinaryMessage))
+	defer httpServer.Close()
+
+	rsp, err := http.Get(httpServer.URL)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, rsp.StatusCode, http.StatusBadRequest)
+	rsp.Body.Close()
+}
+
+func maskedFrame(b0 byte, payload string) []byte {
+	frame := []byte{b0, 0x80 | byte(len(payload)), 1, 2, 3, 4}
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^frame[2+(i&3)])
+	}
+	return frame
+}
+
+func Test_Fragments(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := newConn(c1, bufio.NewReader(c1), false, BinaryMessage)
+
+	go func() {
+		c2.Write(maskedFrame(0x02, "hel"))
+		c2.Write(maskedFrame(0x89, "p"))
+		c2.Write(maskedFrame(0x80, "lo"))
+		c2.Write(maskedFrame(0x88, ""))
+	}()
+
+	pong := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 3)
+		io.ReadFull(c2, b)
+		pong <- b
+		io.Copy(ioutil.Discard, c2)
+	}()
+
+	b, err := ioutil.ReadAll(server)
+	utest.IsNilNow(t, err)
+	utest.EqualNow(t, string(b), "hello")
+	utest.EqualNow(t, <-pong, []byte{0x8A, 1, 'p'})
+	server.Close()
+}